@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ftp-client/state"
+	"ftp-client/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// max time spent creating the Cloud Storage client when the upload is enabled by the admin API
+const enableUploadTimeout = 20 * time.Second
+
+/*
+serverControl lets the admin API act on the goroutine of a server (see waitUntil): a poll can be requested and
+the polls can be paused. It's kept by the supervisor, so that a server stays paused when its goroutine is restarted.
+A nil control (the one of the servers run once) never requests a poll nor pauses the server.
+*/
+type serverControl struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{} // closed when the server is resumed
+	poll    chan struct{} // a poll was requested
+}
+
+func newServerControl() *serverControl {
+	return &serverControl{poll: make(chan struct{}, 1)}
+}
+
+// requestPoll asks for a poll as soon as the cycle in progress (if any) is completed. It fails if the server is paused
+func (c *serverControl) requestPoll() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		return false
+	}
+	select {
+	case c.poll <- struct{}{}:
+	default: // a poll is already pending
+	}
+	return true
+}
+
+func (c *serverControl) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.paused {
+		c.paused, c.resumed = true, make(chan struct{})
+	}
+}
+
+func (c *serverControl) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		c.paused = false
+		close(c.resumed)
+	}
+}
+
+func (c *serverControl) isPaused() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
+// polls returns the channel of the polls requested (nil, which never fires, on a nil control)
+func (c *serverControl) polls() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.poll
+}
+
+// waitResume returns the channel closed when the server is resumed (nil if it's not paused)
+func (c *serverControl) waitResume() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.paused {
+		return nil
+	}
+	return c.resumed
+}
+
+// adminServer is a server listed by the admin API: its settings and its live state
+type adminServer struct {
+	serverCheck
+	ServerName string `json:"server_name,omitempty"`
+	Address    string `json:"address"`
+	Direction  string `json:"direction,omitempty"`
+}
+
+// apiError is the body of the responses of the failed requests
+type apiError struct {
+	Error string `json:"error"`
+}
+
+/*
+handleAdmin serves the admin API, which acts on the running connector:
+  - GET /api/servers, GET /api/servers/{id}: the servers and their live state
+  - POST /api/servers/{id}/poll[?force=true]: polls the server now (the windows of the schedule are not checked)
+  - POST /api/servers/{id}/pause, POST /api/servers/{id}/resume: stops and restarts the polls of the server
+  - POST /api/servers/{id}/redownload?file={name}[&force=true]: transfers the latest version of the file again
+  - POST /api/uploads/enable: enables again the upload to Cloud Storage, after it was disabled
+  - GET /api/failures[?server={id}], POST /api/failures/retry[?server={id}]: the failed deliveries, and their retry
+
+The server can be given by ID or by server_name. Inside a blackout window of the server, poll and redownload are
+refused (409) unless force=true is given, and the failures retried are transferred at the first poll after it.
+The API is enabled only if http.admin_token is set: the requests must have the header "Authorization: Bearer <token>".
+*/
+func (s *supervisor) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	token, err := utils.ResolveSecret(s.adminToken())
+	if err != nil || token == "" {
+		writeJSON(w, http.StatusNotFound, apiError{"the admin API is disabled"})
+		return
+	}
+	if !checkToken(w, r, token) {
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "servers":
+		if allowMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, s.adminServers(""))
+		}
+	case len(path) >= 2 && path[0] == "servers":
+		s.handleAdminServer(w, r, path[1], strings.Join(path[2:], "/"))
+	case len(path) == 2 && path[0] == "uploads" && path[1] == "enable":
+		if allowMethod(w, r, http.MethodPost) {
+			if err := s.enableUpload(r.Context()); err != nil {
+				writeJSON(w, http.StatusServiceUnavailable, apiError{err.Error()})
+				return
+			}
+			s.logger.Info("Upload to Cloud Storage enabled again by the admin API", "remote", r.RemoteAddr)
+			writeJSON(w, http.StatusOK, map[string]bool{"upload_enabled": true})
+		}
+	case len(path) == 1 && path[0] == "failures":
+		if allowMethod(w, r, http.MethodGet) {
+			failures, code, err := s.failures(r.URL.Query().Get("server"))
+			if err != nil {
+				writeJSON(w, code, apiError{err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, failures)
+		}
+	case len(path) == 2 && path[0] == "failures" && path[1] == "retry":
+		if allowMethod(w, r, http.MethodPost) {
+			s.retryFailures(w, r)
+		}
+	default:
+		writeJSON(w, http.StatusNotFound, apiError{"not found"})
+	}
+}
+
+// handleAdminServer serves the requests about a single server
+func (s *supervisor) handleAdminServer(w http.ResponseWriter, r *http.Request, name, action string) {
+	id, ok := s.serverID(name)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, apiError{fmt.Sprintf("unknown server %s", name)})
+		return
+	}
+	if action == "" {
+		if allowMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, s.adminServers(id)[0])
+		}
+		return
+	}
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	control := s.control(id)
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	if (action == "poll" || action == "redownload") && !force && s.inBlackout(id) {
+		writeJSON(w, http.StatusConflict, apiError{"the server is in a blackout window (use force=true to connect anyway)"})
+		return
+	}
+	switch action {
+	case "poll":
+		if !control.requestPoll() {
+			writeJSON(w, http.StatusConflict, apiError{"the server is paused"})
+			return
+		}
+		s.logger.Info("Poll requested by the admin API", "server", id, "forced", force, "remote", r.RemoteAddr)
+		writeJSON(w, http.StatusAccepted, s.adminServers(id)[0])
+	case "pause":
+		control.pause()
+		s.logger.Info("Server paused by the admin API", "server", id, "remote", r.RemoteAddr)
+		writeJSON(w, http.StatusOK, s.adminServers(id)[0])
+	case "resume":
+		control.resume()
+		s.logger.Info("Server resumed by the admin API", "server", id, "remote", r.RemoteAddr)
+		writeJSON(w, http.StatusOK, s.adminServers(id)[0])
+	case "redownload":
+		file := r.URL.Query().Get("file")
+		if file == "" {
+			writeJSON(w, http.StatusBadRequest, apiError{"the file parameter is required"})
+			return
+		}
+		if err := utils.ResetDelivery(s.store, id, file); errors.Is(err, state.ErrNotTracked) {
+			writeJSON(w, http.StatusNotFound, apiError{fmt.Sprintf("file %s not tracked", file)})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusConflict, apiError{err.Error()})
+			return
+		}
+		s.logger.Info("Download requested by the admin API", "server", id, "file", file, "forced", force, "remote", r.RemoteAddr)
+		control.requestPoll() // a paused server transfers the file once resumed
+		writeJSON(w, http.StatusAccepted, map[string]string{"server": id, "file": file})
+	default:
+		writeJSON(w, http.StatusNotFound, apiError{"not found"})
+	}
+}
+
+// retryFailures resets the failed deliveries (of a server, or of all of them) and requests a poll of their servers
+func (s *supervisor) retryFailures(w http.ResponseWriter, r *http.Request) {
+	failures, code, err := s.failures(r.URL.Query().Get("server"))
+	if err != nil {
+		writeJSON(w, code, apiError{err.Error()})
+		return
+	}
+	retried := make([]utils.Failure, 0, len(failures))
+	for _, f := range failures {
+		if err := utils.ResetDelivery(s.store, f.Server, f.File); err != nil {
+			s.logger.Error("Error resetting the delivery", "server", f.Server, "file", f.File, "error", err)
+			continue
+		}
+		retried = append(retried, f)
+		if !s.inBlackout(f.Server) {
+			s.control(f.Server).requestPoll()
+		}
+	}
+	s.logger.Info("Failed deliveries retried by the admin API", "files", len(retried), "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusAccepted, retried)
+}
+
+// inBlackout reports whether the configured server is in one of its blackout windows
+func (s *supervisor) inBlackout(id string) bool {
+	conf, ok := findServer(s.snapshot().config.Servers, id)
+	if !ok {
+		return false
+	}
+	sched, err := utils.NewScheduler(conf)
+	if err != nil {
+		return false // the goroutine of the server is stopped: it's never connected
+	}
+	return sched.InBlackout(time.Now())
+}
+
+// failures returns the failed deliveries of the server (all the configured servers if name is empty)
+func (s *supervisor) failures(name string) ([]utils.Failure, int, error) {
+	var ids []string
+	if name != "" {
+		id, ok := s.serverID(name)
+		if !ok {
+			return nil, http.StatusNotFound, fmt.Errorf("unknown server %s", name)
+		}
+		ids = append(ids, id)
+	} else {
+		for _, c := range s.adminServers("") {
+			ids = append(ids, c.ID)
+		}
+	}
+	failures := []utils.Failure{}
+	for _, id := range ids {
+		f, err := utils.FailedDeliveries(s.store, id)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		failures = append(failures, f...)
+	}
+	return failures, 0, nil
+}
+
+// adminServers returns the configured servers (or only the one with the given ID) with their live state
+func (s *supervisor) adminServers(id string) []adminServer {
+	view := s.snapshot()
+	checks := s.serverChecks(view, time.Now())
+	servers := []adminServer{}
+	for i, conf := range view.config.Servers {
+		if id != "" && checks[i].ID != id {
+			continue
+		}
+		servers = append(servers, adminServer{
+			serverCheck: checks[i],
+			ServerName:  conf.ServerName,
+			Address:     fmt.Sprintf("%s:%d", conf.Host, utils.FTPPort(conf)),
+			Direction:   conf.Direction,
+		})
+	}
+	return servers
+}
+
+// serverID returns the ID of the configured server with the given ID or server_name
+func (s *supervisor) serverID(name string) (string, bool) {
+	conf, ok := findServer(s.snapshot().config.Servers, name)
+	return utils.SourceID(conf), ok
+}
+
+// control returns the control of the server, created the first time
+func (s *supervisor) control(id string) *serverControl {
+	s.controlsMu.Lock()
+	defer s.controlsMu.Unlock()
+	c, ok := s.controls[id]
+	if !ok {
+		c = newServerControl()
+		s.controls[id] = c
+	}
+	return c
+}
+
+/*
+checkToken reports whether the request carries the token, answering 401 if it doesn't. The token is accepted
+as a bearer token or as the password of the basic authentication (e.g. the dashboard in a browser).
+*/
+func checkToken(w http.ResponseWriter, r *http.Request, token string) bool {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, auth, ok = r.BasicAuth()
+	}
+	if !ok || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ftp-client"`)
+		writeJSON(w, http.StatusUnauthorized, apiError{"invalid token"})
+		return false
+	}
+	return true
+}
+
+// adminToken returns the token of the admin API of the configuration in use (it may be a secret reference)
+func (s *supervisor) adminToken() string {
+	return string(s.snapshot().config.HTTP.AdminToken)
+}
+
+/*
+enableUpload enables again the upload to Cloud Storage. If the client couldn't be created (e.g. the bucket was
+unreachable at startup), it's created again, retrying for at most enableUploadTimeout.
+*/
+func (s *supervisor) enableUpload(ctx context.Context) error {
+	if s.cloud.EnableUpload() {
+		return nil
+	}
+	_, cs := s.cloud.Get()
+	if cs.BucketName == "" {
+		return errors.New("no bucket configured")
+	}
+	ctx, cancel := context.WithTimeout(ctx, enableUploadTimeout)
+	defer cancel()
+	client, err := utils.NewClientCloudStorageContext(ctx, cs, s.logger)
+	if err != nil {
+		return fmt.Errorf("creating the Cloud Storage client: %v", err)
+	}
+	s.cloud.Set(client, cs)
+	return nil
+}
+
+// allowMethod checks the method of the request, answering 405 if it's not the allowed one
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, apiError{fmt.Sprintf("method %s not allowed", r.Method)})
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
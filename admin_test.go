@@ -0,0 +1,98 @@
+package main
+
+import (
+	"ftp-client/model"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newAdminSupervisor returns a supervisor without goroutines, whose configuration has the given admin token
+func newAdminSupervisor(token string) *supervisor {
+	now := time.Now().UTC()
+	blackout := &model.Schedule{Timezone: "UTC", Blackouts: []model.Window{
+		{Start: now.Add(-time.Hour).Format("15:04"), End: now.Add(time.Hour).Format("15:04")}, // line3 is in a blackout now
+	}}
+	config := model.Config{
+		Servers: []model.Server{
+			{ID: "line3", Host: "10.10.0.3", Sampling: 1000, Schedule: blackout},
+			{ID: "line4", Host: "10.10.0.4", Sampling: 1000, ServerName: "press"},
+		},
+		HTTP: model.HTTP{AdminToken: model.Secret(token)},
+	}
+	return &supervisor{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), controls: make(map[string]*serverControl),
+		view: supervisorView{config: config}}
+}
+
+func TestAdminAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string // configured
+		auth   string // Authorization header
+		status int
+	}{
+		{"disabled", "", "Bearer ", http.StatusNotFound},
+		{"missing token", "tok", "", http.StatusUnauthorized},
+		{"wrong token", "tok", "Bearer other", http.StatusUnauthorized},
+		{"valid token", "tok", "Bearer tok", http.StatusOK},
+		{"secret reference", "env:TEST_ADMIN_TOKEN", "Bearer from-env", http.StatusOK},
+	}
+	t.Setenv("TEST_ADMIN_TOKEN", "from-env")
+	for _, tt := range tests {
+		s := newAdminSupervisor(tt.token)
+		r := httptest.NewRequest(http.MethodGet, "/api/servers/line4", nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		s.handleAdmin(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d (%s)", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+}
+
+func TestAdminPoll(t *testing.T) {
+	s := newAdminSupervisor("tok")
+	do := func(method, path string) int {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer tok")
+		w := httptest.NewRecorder()
+		s.handleAdmin(w, r)
+		return w.Code
+	}
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodPost, "/api/servers/line3/poll", http.StatusConflict}, // in the blackout window
+		{http.MethodPost, "/api/servers/line3/poll?force=true", http.StatusAccepted},
+		{http.MethodPost, "/api/servers/line4/poll", http.StatusAccepted},
+		{http.MethodPost, "/api/servers/press/poll", http.StatusAccepted}, // by server_name
+		{http.MethodGet, "/api/servers/line4/poll", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/servers/line5/poll", http.StatusNotFound},
+		{http.MethodPost, "/api/servers/line4/pause", http.StatusOK},
+		{http.MethodPost, "/api/servers/line4/poll", http.StatusConflict}, // paused
+		{http.MethodPost, "/api/servers/line4/resume", http.StatusOK},
+		{http.MethodPost, "/api/servers/line4/poll", http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		if got := do(tt.method, tt.path); got != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, got, tt.status)
+		}
+	}
+	// the polls requested while one is pending are merged
+	select {
+	case <-s.control("line4").poll:
+	default:
+		t.Error("no poll requested for line4")
+	}
+	select {
+	case <-s.control("line4").poll:
+		t.Error("more polls pending for line4")
+	default:
+	}
+}
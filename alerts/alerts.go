@@ -0,0 +1,300 @@
+/*
+Package alerts sends email alerts (via SMTP) for the prolonged outages of the connector: an FTP server unreachable
+or the upload to Cloud Storage disabled for longer than the duration of the rule.
+The outages are followed through the events (see package events): an outage sends a single alert, and a recovery
+mail when it ends. The alerts of the same rule and server are spaced by the min interval of the rule, and the
+mails sent in an hour are limited, so that a flapping server doesn't flood the mailboxes.
+*/
+package alerts
+
+import (
+	"fmt"
+	"ftp-client/events"
+	"ftp-client/model"
+	"ftp-client/utils"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mails waiting to be sent
+const queueSize = 100
+
+// attempts to send a mail, and the delay between them
+const (
+	sendAttempts = 3
+	sendRetry    = 10 * time.Second
+)
+
+// recoveries are the types of the events that end the outages
+var recoveries = map[string]string{
+	events.ServerUnreachable: events.ServerRecovered,
+	events.UploadDisabled:    events.UploadEnabled,
+}
+
+// message is a mail to send
+type message struct {
+	to      []string
+	subject string
+	body    string
+}
+
+// outage is an outage followed by a rule
+type outage struct {
+	rule    model.Alert
+	event   events.Event // the event that started the outage
+	timer   *time.Timer  // fires the alert after the duration of the rule
+	alerted bool         // the alert was sent: the recovery is sent as well
+}
+
+/*
+Notifier sends the alerts of the rules configured. Its Notify method is subscribed to the events (see events.Subscribe):
+the mails are sent in background, so the connector is never slowed down by the SMTP server.
+*/
+type Notifier struct {
+	mu      sync.Mutex
+	smtp    *model.SMTP
+	rules   []model.Alert
+	servers map[string]bool      // IDs of the servers configured
+	outages map[string]*outage   // key: see outageKey
+	last    map[string]time.Time // last alert of the outages (same key), for the min interval of the rules
+	sent    []time.Time          // mails sent in the last hour
+	queue   chan message
+	closed  bool          // see Close
+	done    chan struct{} // closed when the mails queued were sent (or given up)
+}
+
+// New returns a notifier of the alerts of the configuration
+func New(config model.Config) *Notifier {
+	n := &Notifier{outages: make(map[string]*outage), last: make(map[string]time.Time), queue: make(chan message, queueSize), done: make(chan struct{})}
+	n.Apply(config)
+	go n.work()
+	return n
+}
+
+/*
+Apply replaces the SMTP settings and the rules (e.g. the configuration was reloaded). The outages of the rules
+and of the servers removed are forgotten.
+*/
+func (n *Notifier) Apply(config model.Config) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.smtp, n.servers = config.SMTP, make(map[string]bool, len(config.Servers))
+	for _, s := range config.Servers {
+		n.servers[utils.SourceID(s)] = true
+	}
+	if !reflect.DeepEqual(n.rules, config.Alerts) && len(config.Alerts) > 0 {
+		slog.Info("Alert rules applied", "rules", len(config.Alerts))
+	}
+	n.rules = config.Alerts
+	for key, o := range n.outages {
+		if !n.hasRule(o.rule) || (o.event.Server != "" && !n.servers[o.event.Server]) {
+			o.timer.Stop()
+			delete(n.outages, key)
+		}
+	}
+}
+
+func (n *Notifier) hasRule(rule model.Alert) bool {
+	for _, r := range n.rules {
+		if reflect.DeepEqual(r, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify follows the outages of the event: an outage starts the timer of its rules, a recovery stops it
+func (n *Notifier) Notify(e events.Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.smtp == nil || n.closed {
+		return
+	}
+	for _, rule := range n.rules {
+		if len(rule.Servers) > 0 && e.Server != "" && !contains(rule.Servers, e.Server) {
+			continue
+		}
+		key := outageKey(rule, e)
+		switch e.Type {
+		case rule.Event:
+			if _, ok := n.outages[key]; ok {
+				continue // the same outage (e.g. the goroutine of the server was restarted)
+			}
+			o := &outage{rule: rule, event: e}
+			o.timer = time.AfterFunc(time.Duration(rule.After)*time.Millisecond, func() { n.fire(key, o) })
+			n.outages[key] = o
+		case recoveries[rule.Event]:
+			o, ok := n.outages[key]
+			if !ok {
+				continue
+			}
+			o.timer.Stop()
+			delete(n.outages, key)
+			if o.alerted {
+				subject, body := recoveryMail(o, e)
+				n.send(rule, subject, body)
+			}
+		}
+	}
+}
+
+// fire sends the alert of the outage, if it's still going on
+func (n *Notifier) fire(key string, o *outage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.outages[key] != o {
+		return // recovered (or forgotten) in the meantime
+	}
+	log := slog.With("rule", ruleName(o.rule), "event", o.rule.Event, "server", o.event.Server)
+	if last, ok := n.last[key]; ok && time.Since(last) < time.Duration(o.rule.MinInterval)*time.Millisecond {
+		log.Warn("Alert not sent: the last one of the rule was sent less than min_interval ago", "last", last.Format(time.RFC3339))
+		return
+	}
+	subject, body := outageMail(o)
+	if n.send(o.rule, subject, body) {
+		o.alerted = true
+		n.last[key] = time.Now()
+	}
+}
+
+// send queues the mail, unless the max mails per hour were sent. It's called with the lock held
+func (n *Notifier) send(rule model.Alert, subject, body string) bool {
+	now := time.Now()
+	recent := n.sent[:0]
+	for _, t := range n.sent {
+		if now.Sub(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	n.sent = recent
+	if len(n.sent) >= n.smtp.MaxPerHour {
+		slog.Error("Alert not sent: max mails per hour reached", "rule", ruleName(rule), "subject", subject, "max_per_hour", n.smtp.MaxPerHour)
+		return false
+	}
+	select {
+	case n.queue <- message{to: rule.To, subject: subject, body: body}:
+		n.sent = append(n.sent, now)
+		return true
+	default:
+		slog.Error("Alert not sent: queue full", "rule", ruleName(rule), "subject", subject)
+		return false
+	}
+}
+
+/*
+Close stops the notifier, waiting at most the timeout for the mails queued to be sent (e.g. before the process
+exits): the outages not alerted yet are forgotten. It reports whether the mails were all sent (or given up).
+*/
+func (n *Notifier) Close(timeout time.Duration) bool {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		for key, o := range n.outages {
+			o.timer.Stop()
+			delete(n.outages, key)
+		}
+		close(n.queue)
+	}
+	n.mu.Unlock()
+	select {
+	case <-n.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// work sends the mails queued with the SMTP settings in use, retrying the failed ones a few times
+func (n *Notifier) work() {
+	defer close(n.done)
+	for m := range n.queue {
+		for attempt := 1; ; attempt++ {
+			n.mu.Lock()
+			conf := n.smtp
+			n.mu.Unlock()
+			if conf == nil {
+				slog.Error("Alert not sent: no SMTP server configured", "subject", m.subject)
+				break
+			}
+			err := Send(*conf, m.to, m.subject, m.body)
+			if err == nil {
+				slog.Info("Alert sent", "subject", m.subject, "to", strings.Join(m.to, ", "), "attempt", attempt)
+				break
+			}
+			if attempt >= sendAttempts {
+				slog.Error("Alert not sent", "subject", m.subject, "attempt", attempt, "error", err)
+				break
+			}
+			slog.Warn("Error sending alert: retrying", "subject", m.subject, "attempt", attempt, "error", err)
+			time.Sleep(sendRetry)
+		}
+	}
+}
+
+// outageMail returns the subject and the body of the alert of the outage
+func outageMail(o *outage) (string, string) {
+	e := o.event
+	d := time.Since(e.Time).Round(time.Second)
+	var subject string
+	var b strings.Builder
+	switch o.rule.Event {
+	case events.ServerUnreachable:
+		subject = fmt.Sprintf("[ftpc] Server %s (%s) unreachable for %s", e.Server, e.Host, d)
+		fmt.Fprintf(&b, "The FTP server %s (%s) can't be reached since %s.\n", e.Server, e.Host, e.Time.Local().Format(time.RFC1123))
+		fmt.Fprintln(&b, "The connector keeps retrying: its files are downloaded as soon as it's reachable again.")
+	case events.UploadDisabled:
+		subject = fmt.Sprintf("[ftpc] Upload to Cloud Storage disabled for %s", d)
+		fmt.Fprintf(&b, "The upload to the bucket %s is disabled since %s: the files are saved locally.\n", e.Bucket, e.Time.Local().Format(time.RFC1123))
+		fmt.Fprintln(&b, "It's enabled again when the cloud_storage settings are reloaded, or with the admin API (POST /api/uploads/enable).")
+	}
+	if e.Error != "" {
+		fmt.Fprintf(&b, "\nError: %s\n", e.Error)
+	}
+	fmt.Fprintf(&b, "\nAnother mail will be sent when the outage ends.\n%s", footer(o.rule))
+	return subject, b.String()
+}
+
+// recoveryMail returns the subject and the body of the mail sent when the outage ends
+func recoveryMail(o *outage, e events.Event) (string, string) {
+	d := e.Time.Sub(o.event.Time).Round(time.Second)
+	var subject, text string
+	switch o.rule.Event {
+	case events.ServerUnreachable:
+		subject = fmt.Sprintf("[ftpc] Server %s (%s) recovered", o.event.Server, o.event.Host)
+		text = fmt.Sprintf("The FTP server %s (%s) is reachable again, after %s.\n", o.event.Server, o.event.Host, d)
+	case events.UploadDisabled:
+		subject = "[ftpc] Upload to Cloud Storage enabled again"
+		text = fmt.Sprintf("The upload to the bucket %s is enabled again, after %s.\n", e.Bucket, d)
+	}
+	return subject, text + footer(o.rule)
+}
+
+func footer(rule model.Alert) string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("\n--\nFTP connector on %s, alert rule %s\n", host, ruleName(rule))
+}
+
+// outageKey identifies the outage of the event followed by the rule (it doesn't change if the rules are reordered)
+func outageKey(rule model.Alert, e events.Event) string {
+	return fmt.Sprintf("%+v|%s", rule, e.Server)
+}
+
+func ruleName(rule model.Alert) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return rule.Event
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package alerts
+
+import (
+	"bytes"
+	"ftp-client/events"
+	"ftp-client/model"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpStub is an SMTP server that accepts every mail, without TLS nor authentication
+type smtpStub struct {
+	listener net.Listener
+	subjects chan string // subjects of the mails received
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStub{listener: l, subjects: make(chan string, 100)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 stub ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, _, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-stub\r\n250 8BITMIME")
+		case "DATA":
+			tp.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			msg, err := mail.ReadMessage(bytes.NewReader(data))
+			if err != nil {
+				return
+			}
+			subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+			s.subjects <- subject
+			tp.PrintfLine("250 OK: queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default: // MAIL, RCPT, RSET, NOOP
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+// config returns a configuration with the given servers and rules, whose alerts are sent to the stub
+func (s *smtpStub) config(maxPerHour int, servers []string, rules ...model.Alert) model.Config {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	config := model.Config{
+		SMTP: &model.SMTP{Host: "127.0.0.1", Port: addr.Port, From: "ftpc@example.com", Security: model.SMTPNone,
+			Timeout: 2000, MaxPerHour: maxPerHour},
+		Alerts: rules,
+	}
+	for _, id := range servers {
+		config.Servers = append(config.Servers, model.Server{ID: id, Host: id + ".example.com"})
+	}
+	return config
+}
+
+// expect waits for the mails with the given subjects (each subject must contain the text given) and checks that no
+// other mail arrives
+func (s *smtpStub) expect(t *testing.T, subjects ...string) {
+	t.Helper()
+	for i, want := range subjects {
+		select {
+		case got := <-s.subjects:
+			if !strings.Contains(got, want) {
+				t.Errorf("mail %d: subject %q, want it to contain %q", i+1, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("mail %d (%q) not received", i+1, want)
+		}
+	}
+	select {
+	case got := <-s.subjects:
+		t.Errorf("unexpected mail %q", got)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func unreachable(server string) events.Event {
+	return events.Event{Type: events.ServerUnreachable, Time: time.Now(), Server: server, Host: server + ".example.com", Error: "connection refused"}
+}
+
+func recovered(server string) events.Event {
+	return events.Event{Type: events.ServerRecovered, Time: time.Now(), Server: server, Host: server + ".example.com"}
+}
+
+func rule(after, minInterval time.Duration) model.Alert {
+	return model.Alert{Event: events.ServerUnreachable, After: int(after.Milliseconds()), To: []string{"ops@example.com"},
+		MinInterval: int(minInterval.Milliseconds())}
+}
+
+func TestAlertAndRecovery(t *testing.T) {
+	stub := newSMTPStub(t)
+	n := New(stub.config(10, []string{"line3"}, rule(50*time.Millisecond, 0)))
+	defer n.Close(time.Second)
+
+	n.Notify(unreachable("line3"))
+	n.Notify(unreachable("line3")) // the same outage (e.g. the goroutine of the server was restarted)
+	stub.expect(t, "Server line3 (line3.example.com) unreachable")
+	n.Notify(recovered("line3"))
+	n.Notify(recovered("line3")) // no outage in progress
+	stub.expect(t, "Server line3 (line3.example.com) recovered")
+}
+
+func TestRecoveryBeforeAfter(t *testing.T) {
+	stub := newSMTPStub(t)
+	n := New(stub.config(10, []string{"line3"}, rule(200*time.Millisecond, 0)))
+	defer n.Close(time.Second)
+
+	n.Notify(unreachable("line3"))
+	time.Sleep(20 * time.Millisecond)
+	n.Notify(recovered("line3"))
+	time.Sleep(300 * time.Millisecond) // after the duration of the rule
+	stub.expect(t)
+}
+
+func TestMinInterval(t *testing.T) {
+	stub := newSMTPStub(t)
+	n := New(stub.config(10, []string{"line3", "line4"}, rule(20*time.Millisecond, time.Hour)))
+	defer n.Close(time.Second)
+
+	n.Notify(unreachable("line3"))
+	stub.expect(t, "line3 (line3.example.com) unreachable")
+	n.Notify(recovered("line3"))
+	stub.expect(t, "line3 (line3.example.com) recovered")
+	// the next outage of the same server is not alerted (nor its recovery), the ones of the other servers are
+	n.Notify(unreachable("line3"))
+	n.Notify(unreachable("line4"))
+	stub.expect(t, "line4 (line4.example.com) unreachable")
+	n.Notify(recovered("line3"))
+	stub.expect(t)
+}
+
+func TestMaxPerHour(t *testing.T) {
+	stub := newSMTPStub(t)
+	servers := []string{"line1", "line2", "line3"}
+	n := New(stub.config(2, servers, rule(20*time.Millisecond, 0)))
+	defer n.Close(time.Second)
+
+	for i, id := range servers {
+		n.Notify(unreachable(id))
+		if i < 2 {
+			stub.expect(t, id+" ("+id+".example.com) unreachable")
+		}
+	}
+	// the third alert and the recoveries are dropped
+	for _, id := range servers {
+		n.Notify(recovered(id))
+	}
+	stub.expect(t)
+}
+
+func TestCloseSendsQueue(t *testing.T) {
+	stub := newSMTPStub(t)
+	servers := make([]string, 5)
+	for i := range servers {
+		servers[i] = "line" + strconv.Itoa(i)
+	}
+	n := New(stub.config(10, servers, rule(0, 0)))
+	for _, id := range servers {
+		n.Notify(unreachable(id))
+	}
+	time.Sleep(50 * time.Millisecond) // the alerts are queued
+	if !n.Close(5 * time.Second) {
+		t.Fatal("Close timed out")
+	}
+	if got := len(stub.subjects); got != len(servers) {
+		t.Errorf("%d mails sent before Close returned, want %d", got, len(servers))
+	}
+	n.Notify(recovered("line0")) // ignored after Close
+}
@@ -0,0 +1,109 @@
+package alerts
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"ftp-client/model"
+	"ftp-client/utils"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Send sends a plain text mail with the SMTP server: the connection is encrypted as configured (STARTTLS, implicit TLS
+or none) and authenticated if a user is set. The password is read at every mail, since it can be a secret reference.
+*/
+func Send(conf model.SMTP, to []string, subject, body string) error {
+	password, err := utils.ResolveSecret(string(conf.Password))
+	if err != nil {
+		return fmt.Errorf("reading the SMTP password: %v", err)
+	}
+	from, err := mail.ParseAddress(conf.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender %q: %v", conf.From, err)
+	}
+	addr := net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port))
+	timeout := time.Duration(conf.Timeout) * time.Millisecond
+	dialer := &net.Dialer{Timeout: timeout}
+	tlsConfig := &tls.Config{ServerName: conf.Host}
+
+	var conn net.Conn
+	if conf.Security == model.SMTPTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %v", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, err := smtp.NewClient(conn, conf.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("connecting to %s: %v", addr, err)
+	}
+	defer c.Close()
+
+	if conf.Security == "" || conf.Security == model.SMTPStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("the SMTP server doesn't support STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS: %v", err)
+		}
+	}
+	if conf.User != "" {
+		// PLAIN authentication: net/smtp refuses it on an unencrypted connection, unless the server is local
+		if err := c.Auth(smtp.PlainAuth("", conf.User, password, conf.Host)); err != nil {
+			return fmt.Errorf("authentication: %v", err)
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return fmt.Errorf("MAIL FROM: %v", err)
+	}
+	for _, rcpt := range to {
+		addr, err := mail.ParseAddress(rcpt)
+		if err != nil {
+			return fmt.Errorf("invalid recipient %q: %v", rcpt, err)
+		}
+		if err := c.Rcpt(addr.Address); err != nil {
+			return fmt.Errorf("RCPT TO %s: %v", addr.Address, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("DATA: %v", err)
+	}
+	if _, err := w.Write(buildMessage(from, to, subject, body)); err != nil {
+		return fmt.Errorf("writing the mail: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("writing the mail: %v", err)
+	}
+	return c.Quit()
+}
+
+// buildMessage returns the mail with its headers (the lines end with CRLF, as required by SMTP)
+func buildMessage(from *mail.Address, to []string, subject, body string) []byte {
+	var b bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+	}
+	header("From", from.String())
+	header("To", strings.Join(to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "8bit")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	_ "embed"
+	"ftp-client/events"
+	"ftp-client/utils"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// transfers kept for the table of the dashboard
+const recentTransfers = 100
+
+// dashboardPage is the web UI served at /: it reads /dashboard/state every few seconds
+//
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// transfer is a download or an upload of a file, shown by the dashboard
+type transfer struct {
+	Time      time.Time `json:"time"`
+	Server    string    `json:"server"`
+	Direction string    `json:"direction"` // download or upload
+	File      string    `json:"file"`
+	Size      int64     `json:"size"`
+	Duration  float64   `json:"duration_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// transferLog keeps the latest transfers, collected from the events (see add)
+type transferLog struct {
+	mu    sync.Mutex
+	items []transfer // ring buffer
+	next  int        // position of the next transfer in items, once it's full
+}
+
+// add records the event, if it's a transfer. It's subscribed to the events (see events.Subscribe)
+func (l *transferLog) add(e events.Event) {
+	t := transfer{Time: e.Time, Server: e.Server, File: e.File, Size: e.Size, Duration: e.Duration, Error: e.Error}
+	switch e.Type {
+	case events.FileDownloaded, events.DownloadFailed:
+		t.Direction = "download"
+	case events.FileUploaded, events.UploadFailed:
+		t.Direction = "upload"
+	default:
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.items) < recentTransfers {
+		l.items = append(l.items, t)
+		return
+	}
+	l.items[l.next] = t
+	l.next = (l.next + 1) % recentTransfers
+}
+
+// list returns the transfers, the latest first
+func (l *transferLog) list() []transfer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]transfer, 0, len(l.items))
+	for i := len(l.items) - 1; i >= 0; i-- {
+		list = append(list, l.items[(l.next+i)%len(l.items)])
+	}
+	return list
+}
+
+// dashboardServer is a card of the dashboard
+type dashboardServer struct {
+	adminServer
+	FilesToday int `json:"files_today"` // files with a new version found since midnight
+}
+
+// uploadState is the state of the upload to Cloud Storage shown by the dashboard
+type uploadState struct {
+	Bucket  string `json:"bucket,omitempty"` // empty: the files are always saved locally
+	Enabled bool   `json:"enabled"`          // false: the upload was disabled after the failed attempts (circuit open)
+	Queue   int    `json:"queue"`            // files waiting to be uploaded
+}
+
+type dashboardState struct {
+	Time      time.Time         `json:"time"`
+	Servers   []dashboardServer `json:"servers"`
+	Upload    uploadState       `json:"upload"`
+	Transfers []transfer        `json:"transfers"`
+}
+
+// handleDashboard serves the page of the dashboard
+func (s *supervisor) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
+
+// handleDashboardState serves the state shown by the dashboard: the servers, the upload and the latest transfers
+func (s *supervisor) handleDashboardState(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	resp := dashboardState{Time: now.UTC(), Servers: []dashboardServer{}, Transfers: s.transfers.list()}
+	for _, server := range s.adminServers("") {
+		n, err := utils.FilesSeenSince(s.store, server.ID, midnight)
+		if err != nil {
+			s.logger.Error("Error reading the state", "server", server.ID, "error", err)
+		}
+		resp.Servers = append(resp.Servers, dashboardServer{adminServer: server, FilesToday: n})
+	}
+	_, cs := s.cloud.Get()
+	resp.Upload = uploadState{Bucket: cs.BucketName, Enabled: s.cloud.UploadEnabled(), Queue: len(s.fileChannel)}
+	writeJSON(w, http.StatusOK, resp)
+}
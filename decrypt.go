@@ -0,0 +1,147 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"ftp-client/model"
+	"ftp-client/utils"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+decryptCommand restores a file encrypted by the connector (either a local file or an object downloaded from the bucket).
+Usage: decrypt [-key <key file>] [-keep-compressed] <input> [output]
+
+If no key file is given, the keys of the configuration file are used (the right one is selected with the key ID stored in the file).
+The output file defaults to the input path without the ".enc" suffix. Unless -keep-compressed is set, a ".gz" or ".zst"
+file is also decompressed (and the suffix removed).
+It returns the exit code of the command.
+*/
+func decryptCommand(args []string) int {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyFile := fs.String("key", "", "file containing the 256-bit master key (default: the keys of the configuration file)")
+	keepCompressed := fs.Bool("keep-compressed", false, "don't decompress the decrypted file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: decrypt [-key <key file>] [-keep-compressed] <input> [output]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	keys, err := decryptionKeys(*keyFile)
+	if err != nil {
+		fmt.Println("Error loading keys: ", err)
+		return 1
+	}
+
+	input := fs.Arg(0)
+	output := strings.TrimSuffix(input, utils.EncryptionSuffix)
+	decompress := ""
+	if !*keepCompressed {
+		for _, alg := range []string{utils.CompressionGzip, utils.CompressionZstd} {
+			if suffix := utils.CompressionSuffix(&model.Compression{Algorithm: alg}); strings.HasSuffix(output, suffix) {
+				decompress = alg
+				output = strings.TrimSuffix(output, suffix)
+			}
+		}
+	}
+	if fs.NArg() == 2 {
+		output = fs.Arg(1)
+	}
+	if output == input {
+		fmt.Println("The output file must be different from the input file")
+		return 2
+	}
+
+	if err := decryptFile(input, output, keys, decompress); err != nil {
+		os.Remove(output)
+		fmt.Printf("Error decrypting %s: %s\n", input, err)
+		return 1
+	}
+	fmt.Printf("File %s decrypted to %s\n", input, output)
+	return 0
+}
+
+// decryptFile decrypts the input file to the output one, decompressing it with the given algorithm (if not empty)
+func decryptFile(input, output string, keys map[string][]byte, decompress string) error {
+	in, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, keyID, err := utils.NewDecryptReader(in, keys)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("File %s encrypted with key %s\n", input, keyID)
+
+	switch decompress {
+	case utils.CompressionGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	case utils.CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	out, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, r); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// decryptionKeys returns the master keys (by key ID) read from the given key file or, if empty, from the configuration file
+func decryptionKeys(keyFile string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	if keyFile != "" {
+		key, err := utils.LoadEncryptionKey(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys[utils.AnyKeyID] = key // the key given explicitly is used whatever the key ID of the file
+		return keys, nil
+	}
+
+	config, err := utils.LoadConfiguration(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading configuration: %v", err)
+	}
+	encryptions := []*model.Encryption{config.Encryption}
+	for _, server := range config.Servers {
+		encryptions = append(encryptions, server.Encryption)
+	}
+	for _, e := range encryptions {
+		enc, err := utils.NewEncryptor(e)
+		if err != nil {
+			return nil, err
+		}
+		if enc != nil {
+			keys[enc.KeyID] = enc.Key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no encryption key in the configuration file: use -key")
+	}
+	return keys, nil
+}
@@ -0,0 +1,100 @@
+/*
+Package events dispatches the events of the connector (e.g. a file deleted from an FTP server) to the subscribers
+registered at startup, so that downstream consumers can react to them.
+*/
+package events
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// event types
+const (
+	FileDetected      = "file_detected"      // a new file, or a new version of a file, was found on the FTP server
+	FileDeleted       = "file_deleted"       // a tracked file was deleted from the FTP server (mirror mode)
+	FileDownloaded    = "file_downloaded"    // a file was downloaded from the FTP server (to the uploader or to a local copy)
+	FileUploaded      = "file_uploaded"      // a file was uploaded to Cloud Storage
+	DownloadFailed    = "download_failed"    // a file couldn't be downloaded from the FTP server (or saved locally)
+	UploadFailed      = "upload_failed"      // a file couldn't be uploaded to Cloud Storage (it's saved locally, unless in conflict)
+	FileDelivered     = "file_delivered"     // the delivery of a version of a file (to the bucket or locally) was confirmed
+	DeliveryFailed    = "delivery_failed"    // the delivery of a version of a file failed (it's retried in the next polls)
+	UploadDisabled    = "upload_disabled"    // the upload to Cloud Storage was disabled: the files are saved locally
+	UploadEnabled     = "upload_enabled"     // the upload to Cloud Storage was enabled again
+	ServerUnreachable = "server_unreachable" // the connection to the FTP server failed (it's retried)
+	ServerRecovered   = "server_recovered"   // the FTP server was reached again after it was unreachable
+)
+
+// Types are all the event types, e.g. for the filters of the subscribers
+var Types = []string{
+	FileDetected, FileDeleted, FileDownloaded, FileUploaded, DownloadFailed, UploadFailed,
+	FileDelivered, DeliveryFailed, UploadDisabled, UploadEnabled, ServerUnreachable, ServerRecovered,
+}
+
+// Event is something that happened in the connector
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Server   string    `json:"server,omitempty"` // empty for the events of the upload
+	Host     string    `json:"host,omitempty"`
+	File     string    `json:"file,omitempty"`        // name of the file on the FTP server
+	Bucket   string    `json:"bucket,omitempty"`      // bucket of the object (or of the upload)
+	Object   string    `json:"object,omitempty"`      // path of the object in the bucket
+	Local    string    `json:"local,omitempty"`       // path of the local copy of the file
+	Size     int64     `json:"size,omitempty"`        // bytes transferred (or size of the file found)
+	Duration float64   `json:"duration_ms,omitempty"` // duration of the transfer [ms]
+	Hash     string    `json:"hash,omitempty"`        // SHA-256 of the file delivered (before compression and encryption)
+	Error    string    `json:"error,omitempty"`
+}
+
+var (
+	mu          sync.RWMutex
+	subscribers []func(Event)
+)
+
+// Subscribe registers a function that will be called (synchronously) for every event emitted
+func Subscribe(fn func(Event)) {
+	mu.Lock()
+	subscribers = append(subscribers, fn)
+	mu.Unlock()
+}
+
+// Emit sends the event to all the subscribers. If the time of the event is not set, the current time is used
+func Emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, fn := range subscribers {
+		fn(e)
+	}
+}
+
+/*
+NewJSONWriter returns a subscriber that writes every event, as a JSON line, to the given writer
+(e.g. the log/events.log file, that can be tailed by the downstream consumers).
+*/
+func NewJSONWriter(w io.Writer) func(Event) {
+	var wmu sync.Mutex
+	return func(e Event) {
+		b, err := json.Marshal(e)
+		if err != nil {
+			slog.Error("Error encoding event", "error", err)
+			return
+		}
+		wmu.Lock()
+		defer wmu.Unlock()
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			slog.Error("Error writing event", "error", err)
+		}
+	}
+}
+
+// Milliseconds returns the duration in milliseconds, as the Duration of the events
+func Milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
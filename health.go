@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"ftp-client/utils"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// time without iterations of the configuration loop after which the connector is considered stuck
+const heartbeatTimeout = 6 * configCheckInterval
+
+// the result of the check of the bucket is reused for a while, so that the probes don't hit Cloud Storage every time
+const (
+	bucketCheckTTL     = 30 * time.Second
+	bucketCheckTimeout = 5 * time.Second
+)
+
+/*
+serverHealth is the live state of the goroutine of a server (see watchServer), read by the health endpoints.
+The methods are no-ops on a nil value, which is the one of the servers run once.
+*/
+type serverHealth struct {
+	mu        sync.Mutex
+	connected bool
+	lastPoll  time.Time // last successful poll
+	due       time.Time // when the first poll after the last successful one is (or was) scheduled
+	polled    bool      // a poll succeeded after due was set
+	next      time.Time // when the next poll is scheduled (zero: never)
+	lastError string
+}
+
+func newServerHealth() *serverHealth {
+	return &serverHealth{polled: true} // the first poll scheduled is the one due
+}
+
+func (h *serverHealth) setConnected(connected bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.connected = connected
+	h.mu.Unlock()
+}
+
+func (h *serverHealth) pollSucceeded() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.lastPoll, h.polled, h.lastError = time.Now(), true, ""
+	h.mu.Unlock()
+}
+
+func (h *serverHealth) fail(err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.lastError = err.Error()
+	h.mu.Unlock()
+}
+
+// scheduled records the time of the next poll: only the first one after a successful poll is due
+func (h *serverHealth) scheduled(t time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.next = t
+	if h.polled {
+		h.due, h.polled = t, false
+	}
+	h.mu.Unlock()
+}
+
+/*
+stale reports whether the server is late: the poll due wasn't done successfully within the threshold
+(the servers waiting for the next time of their schedule, e.g. a nightly cron expression, are not late).
+*/
+func (h *serverHealth) stale(now time.Time, threshold time.Duration) bool {
+	return !h.due.IsZero() && !h.polled && now.After(h.due.Add(threshold))
+}
+
+// serverCheck is the state of a server reported by the health endpoints
+type serverCheck struct {
+	ID        string    `json:"id"`
+	Running   bool      `json:"running"` // the goroutine of the server is alive
+	Ready     bool      `json:"ready,omitempty"`
+	Paused    bool      `json:"paused"` // the polls were paused by the admin API
+	Connected bool      `json:"connected"`
+	LastPoll  time.Time `json:"last_poll,omitempty"` // last successful poll
+	NextPoll  time.Time `json:"next_poll,omitempty"` // next poll scheduled
+	Stale     bool      `json:"stale"`               // the last successful poll is older than the threshold
+	Error     string    `json:"error,omitempty"`     // last error of the server
+}
+
+// cloudCheck is the state of the upload to Cloud Storage reported by /readyz
+type cloudCheck struct {
+	Bucket        string `json:"bucket,omitempty"`
+	Reachable     bool   `json:"reachable"`
+	UploadEnabled bool   `json:"upload_enabled"` // false: the files are saved locally
+	Error         string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status        string        `json:"status"` // ok or fail
+	LastHeartbeat time.Time     `json:"last_heartbeat"`
+	Servers       []serverCheck `json:"servers"`
+}
+
+type readyResponse struct {
+	Status  string        `json:"status"`          // ready or not_ready
+	Cloud   *cloudCheck   `json:"cloud,omitempty"` // omitted if no bucket is configured
+	Servers []serverCheck `json:"servers"`
+}
+
+// bucketCheck caches the result of the check of the bucket (see utils.ClientCloudStorage.CheckBucket)
+type bucketCheck struct {
+	mu     sync.Mutex
+	client *utils.ClientCloudStorage
+	at     time.Time
+	err    error
+}
+
+func (b *bucketCheck) check(client *utils.ClientCloudStorage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if client != b.client || time.Since(b.at) > bucketCheckTTL {
+		ctx, cancel := context.WithTimeout(context.Background(), bucketCheckTimeout)
+		defer cancel()
+		b.client, b.at, b.err = client, time.Now(), client.CheckBucket(ctx)
+	}
+	return b.err
+}
+
+// checkServers returns the state of the goroutines of the configured servers
+func (s *supervisor) checkServers(now time.Time) []serverCheck {
+	return s.serverChecks(s.snapshot(), now)
+}
+
+// serverChecks returns the state of the goroutines of the servers of the snapshot
+func (s *supervisor) serverChecks(view supervisorView, now time.Time) []serverCheck {
+	threshold := time.Duration(view.config.HTTP.StaleAfter) * time.Millisecond
+	checks := make([]serverCheck, 0, len(view.config.Servers))
+	for _, conf := range view.config.Servers {
+		c := serverCheck{ID: utils.SourceID(conf)}
+		c.Paused = s.control(c.ID).isPaused()
+		if w, ok := view.watchers[c.ID]; ok {
+			// a goroutine returned on its own is dead (the ones stopped by the supervisor are being restarted or removed)
+			select {
+			case <-w.done:
+				c.Running = w.stopping.Load()
+			default:
+				c.Running = true
+			}
+			w.health.mu.Lock()
+			c.Connected, c.LastPoll, c.NextPoll, c.Error = w.health.connected, w.health.lastPoll, w.health.next, w.health.lastError
+			c.Stale = w.health.stale(now, threshold)
+			w.health.mu.Unlock()
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+/*
+handleHealthz reports whether the process and its loops are alive: the configuration loop has run recently and
+no goroutine of a server has returned on its own (e.g. for an invalid encryption key). The status code is 200 or 503.
+*/
+func (s *supervisor) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	resp := healthResponse{Status: "ok", LastHeartbeat: time.Unix(0, s.heartbeat.Load()).UTC()}
+	if now.Sub(resp.LastHeartbeat) > heartbeatTimeout {
+		resp.Status = "fail"
+	}
+	resp.Servers = s.checkServers(now)
+	for i := range resp.Servers {
+		if !resp.Servers[i].Running {
+			resp.Status = "fail"
+		}
+	}
+	writeHealth(w, resp, resp.Status == "ok")
+}
+
+/*
+handleReadyz reports whether the connector is doing its job: every server (unless paused) is connected and was polled
+successfully within the staleness threshold, the bucket is reachable and the files are still uploaded to it (and not saved locally).
+The status code is 200 or 503.
+*/
+func (s *supervisor) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	resp := readyResponse{Status: "ready", Servers: s.checkServers(time.Now())}
+	ready := true
+	for i, c := range resp.Servers {
+		// the paused servers are not polled on purpose
+		resp.Servers[i].Ready = c.Running && (c.Paused || (c.Connected && !c.Stale))
+		ready = ready && resp.Servers[i].Ready
+	}
+	if client, cs := s.cloud.Get(); cs.BucketName != "" {
+		resp.Cloud = &cloudCheck{Bucket: cs.BucketName, UploadEnabled: s.cloud.UploadEnabled()}
+		if client == nil {
+			resp.Cloud.Error = "the Cloud Storage client could not be created"
+		} else if err := s.bucket.check(client); err != nil {
+			resp.Cloud.Error = err.Error()
+		} else {
+			resp.Cloud.Reachable = true
+		}
+		ready = ready && resp.Cloud.Reachable && resp.Cloud.UploadEnabled
+	}
+	if !ready {
+		resp.Status = "not_ready"
+	}
+	writeHealth(w, resp, ready)
+}
+
+func writeHealth(w http.ResponseWriter, resp interface{}, ok bool) {
+	if ok {
+		writeJSON(w, http.StatusOK, resp)
+	} else {
+		writeJSON(w, http.StatusServiceUnavailable, resp)
+	}
+}
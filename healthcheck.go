@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"ftp-client/utils"
+	"net"
+	"net/http"
+	"time"
+)
+
+/*
+healthcheckCommand checks /healthz on the HTTP server of the connector running, at the address of http.listen
+(the healthcheck of the Docker image). An address without host, or with an unspecified one (e.g. ":9090" or
+"0.0.0.0:9090"), is checked on the loopback interface.
+Usage: healthcheck [-timeout d]
+It returns the exit code of the command: 0 if the connector is healthy (or the HTTP server is not enabled), 1 otherwise.
+*/
+func healthcheckCommand(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 4*time.Second, "timeout of the request")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: healthcheck [-timeout d]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	config, err := utils.LoadConfiguration(configFile)
+	if err != nil {
+		fmt.Printf("Invalid configuration:\n%s\n", err)
+		return 1
+	}
+	if config.HTTP.Listen == "" {
+		fmt.Println("The HTTP server is not enabled (http.listen): nothing to check")
+		return 0
+	}
+	host, port, err := net.SplitHostPort(config.HTTP.Listen)
+	if err != nil {
+		fmt.Printf("Invalid http.listen %q: %v\n", config.HTTP.Listen, err)
+		return 1
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	url := fmt.Sprintf("http://%s/healthz", net.JoinHostPort(host, port))
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		fmt.Printf("%s: %v\n", url, err)
+		return 1
+	}
+	resp.Body.Close()
+	fmt.Printf("%s: %s\n", url, resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"ftp-client/model"
+	"ftp-client/state"
+	"ftp-client/utils"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+historyCommand prints the history of the versions of a file tracked on an FTP server (read from the state store).
+Usage: history [-json] <server> <file>, where <server> is the ID of the server (or its server_name, if unique).
+It returns the exit code of the command.
+*/
+func historyCommand(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the history as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: history [-json] <server id or server_name> <file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	serverName, filename := fs.Arg(0), fs.Arg(1)
+
+	config, err := utils.LoadConfiguration(configFile)
+	if err != nil {
+		fmt.Printf("Invalid configuration:\n%s\n", err)
+		return 1
+	}
+	serverName = resolveSourceID(config.Servers, serverName)
+	store, err := state.OpenReadOnly(config.State, utils.StateDirectory())
+	if err != nil {
+		fmt.Println("Error opening the state: ", err)
+		return 1
+	}
+	defer store.Close()
+	info, ok, err := store.Get(serverName, filename)
+	if err != nil {
+		fmt.Println("Error reading the state: ", err)
+		return 1
+	}
+	if !ok {
+		fmt.Printf("File %s not tracked for server %s\n", filename, serverName)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(info)
+		return 0
+	}
+
+	fmt.Printf("%s/%s: latest version %s", serverName, filename, formatTimestamp(info.Timestamp))
+	if info.Deleted != 0 {
+		fmt.Printf(", deleted from the server at %s", time.Unix(info.Deleted, 0).UTC().Format(time.RFC3339))
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DETECTED AT\tREMOTE TIME\tSIZE\tSTATUS\tSHA-256\tDESTINATIONS")
+	for _, v := range info.Versions {
+		status := v.Status
+		if v.Error != "" {
+			status += " (" + v.Error + ")"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", v.DetectedAt.Format(time.RFC3339), formatTimestamp(v.Timestamp),
+			v.Size, status, v.Hash, strings.Join(v.Destinations, ", "))
+	}
+	w.Flush()
+	return 0
+}
+
+func formatTimestamp(timestamp uint64) string {
+	return time.Unix(int64(timestamp), 0).UTC().Format(time.RFC3339)
+}
+
+// resolveSourceID returns the ID of the server with the given ID or server_name (the name is returned as is if no server matches)
+func resolveSourceID(servers []model.Server, name string) string {
+	var ids []string
+	for _, s := range servers {
+		if utils.SourceID(s) == name {
+			return name
+		}
+		if s.ServerName == name {
+			ids = append(ids, utils.SourceID(s))
+		}
+	}
+	if len(ids) == 1 {
+		return ids[0]
+	}
+	return name
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"ftp-client/metrics"
+	"ftp-client/model"
+	"ftp-client/utils"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+/*
+serveHTTP starts the HTTP server of the connector on the address of the http settings:
+  - /metrics: the metrics in the Prometheus format
+  - /healthz: whether the process and its loops are alive (see supervisor.handleHealthz)
+  - /readyz: whether the servers are polled and the files uploaded (see supervisor.handleReadyz)
+  - /api/: the admin API, to act on the running connector (see supervisor.handleAdmin)
+  - /: the dashboard, a web UI with the state of the servers and the latest transfers (see supervisor.handleDashboard)
+
+The metrics and the dashboard need the token of the admin API, unless http.public is set (see supervisor.requireToken).
+
+The address is bound before returning (so that an address in use stops the connector), then the requests are
+served in background until the process exits. If the address is not set, the server is not started.
+*/
+func serveHTTP(conf model.HTTP, sup *supervisor, logger *slog.Logger) error {
+	if conf.Listen == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", sup.requireToken(metrics.Handler()))
+	mux.HandleFunc("/healthz", sup.handleHealthz)
+	mux.HandleFunc("/readyz", sup.handleReadyz)
+	mux.HandleFunc("/api/", sup.handleAdmin)
+	mux.Handle("/dashboard/state", sup.requireToken(http.HandlerFunc(sup.handleDashboardState)))
+	mux.Handle("/", sup.requireToken(http.HandlerFunc(sup.handleDashboard)))
+
+	l, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return fmt.Errorf("starting the HTTP server: %v", err)
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	logger.Info("HTTP server started", "address", l.Addr().String())
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+/*
+requireToken wraps the handler of an endpoint that exposes the state of the connector (the metrics and the dashboard):
+the requests must carry the token of the admin API (see checkToken), unless http.public is set. Without the token
+nor http.public, the endpoint answers 403. The settings in use are read at each request (they can be reloaded).
+*/
+func (s *supervisor) requireToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := s.snapshot().config.HTTP
+		if !conf.Public {
+			token, err := utils.ResolveSecret(string(conf.AdminToken))
+			if err != nil || token == "" {
+				writeJSON(w, http.StatusForbidden, apiError{"set http.admin_token (or http.public) to reach " + r.URL.Path})
+				return
+			}
+			if !checkToken(w, r, token) {
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
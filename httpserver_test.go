@@ -0,0 +1,38 @@
+package main
+
+import (
+	"ftp-client/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name   string
+		conf   model.HTTP
+		auth   func(r *http.Request)
+		status int
+	}{
+		{"no token configured", model.HTTP{}, func(r *http.Request) {}, http.StatusForbidden},
+		{"public", model.HTTP{Public: true}, func(r *http.Request) {}, http.StatusOK},
+		{"public with a token", model.HTTP{AdminToken: "tok", Public: true}, func(r *http.Request) {}, http.StatusOK},
+		{"missing token", model.HTTP{AdminToken: "tok"}, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"bearer token", model.HTTP{AdminToken: "tok"}, func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok") }, http.StatusOK},
+		{"wrong bearer token", model.HTTP{AdminToken: "tok"}, func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") }, http.StatusUnauthorized},
+		{"token without Bearer", model.HTTP{AdminToken: "tok"}, func(r *http.Request) { r.Header.Set("Authorization", "tok") }, http.StatusUnauthorized},
+		{"basic authentication", model.HTTP{AdminToken: "tok"}, func(r *http.Request) { r.SetBasicAuth("anyone", "tok") }, http.StatusOK},
+		{"wrong password", model.HTTP{AdminToken: "tok"}, func(r *http.Request) { r.SetBasicAuth("anyone", "other") }, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		s := &supervisor{view: supervisorView{config: model.Config{HTTP: tt.conf}}}
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		tt.auth(r)
+		w := httptest.NewRecorder()
+		s.requireToken(ok).ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
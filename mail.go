@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"ftp-client/alerts"
+	"ftp-client/utils"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// default address of the local SMTP server of the mail stub command
+const defaultStubAddress = "127.0.0.1:2525"
+
+/*
+mailCommand tries the email alerts of the configuration.
+Usage:
+  - mail test [to ...]: sends a test mail to the given recipients (default: the recipients of all the alert rules)
+  - mail stub [address]: runs a local SMTP server, which accepts every mail and prints it (e.g. with the smtp
+    settings "host": "127.0.0.1", "port": 2525, "security": "none")
+
+It returns the exit code of the command.
+*/
+func mailCommand(args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: mail test [to ...] | mail stub [address]")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	switch args[0] {
+	case "test":
+		return mailTest(args[1:])
+	case "stub":
+		return mailStub(args[1:])
+	}
+	usage()
+	return 2
+}
+
+// mailTest sends a test mail with the SMTP settings of the configuration
+func mailTest(args []string) int {
+	fs := flag.NewFlagSet("mail test", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mail test [to ...] (default: the recipients of the alert rules)")
+	}
+	fs.Parse(args)
+	config, err := utils.LoadConfiguration(configFile)
+	if err != nil {
+		fmt.Printf("Invalid configuration:\n%s\n", err)
+		return 1
+	}
+	if config.SMTP == nil {
+		fmt.Println("No SMTP server configured")
+		return 1
+	}
+	to := fs.Args()
+	if len(to) == 0 {
+		seen := make(map[string]bool)
+		for _, rule := range config.Alerts {
+			for _, rcpt := range rule.To {
+				if !seen[rcpt] {
+					seen[rcpt] = true
+					to = append(to, rcpt)
+				}
+			}
+		}
+	}
+	if len(to) == 0 {
+		fmt.Println("No recipients: give them as arguments, or configure an alert rule")
+		return 1
+	}
+	host, _ := os.Hostname()
+	body := fmt.Sprintf("This is a test mail of the FTP connector on %s, sent at %s.\n", host, time.Now().Format(time.RFC1123))
+	if err := alerts.Send(*config.SMTP, to, "[ftpc] Test mail", body); err != nil {
+		fmt.Println("Error sending the mail: ", err)
+		return 1
+	}
+	fmt.Printf("Test mail sent to %s\n", strings.Join(to, ", "))
+	return 0
+}
+
+// mailStub runs a local SMTP server that prints the mails received (any authentication is accepted)
+func mailStub(args []string) int {
+	fs := flag.NewFlagSet("mail stub", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mail stub [address] (default: %s)\n", defaultStubAddress)
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	address := defaultStubAddress
+	if fs.NArg() == 1 {
+		address = fs.Arg(0)
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		fmt.Println("Error starting the SMTP stub: ", err)
+		return 1
+	}
+	fmt.Printf("SMTP stub listening on %s (no TLS: use \"security\": \"none\")\n", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println("Error accepting the connection: ", err)
+			return 1
+		}
+		go serveStubSession(conn)
+	}
+}
+
+// serveStubSession serves an SMTP session of the stub
+func serveStubSession(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	reply := func(format string, args ...interface{}) bool {
+		return tp.PrintfLine(format, args...) == nil
+	}
+	// readAuth reads a line of the AUTH exchange (base64)
+	readAuth := func(prompt string) string {
+		reply("334 %s", prompt)
+		line, _ := tp.ReadLine()
+		b, _ := base64.StdEncoding.DecodeString(line)
+		return string(b)
+	}
+
+	var from, user string
+	var to []string
+	reply("220 ftpc-stub ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			reply("250-ftpc-stub\r\n250-AUTH PLAIN LOGIN\r\n250 8BITMIME")
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			switch strings.ToUpper(mechanism) {
+			case "PLAIN":
+				if initial == "" {
+					initial = base64.StdEncoding.EncodeToString([]byte(readAuth("")))
+				}
+				b, _ := base64.StdEncoding.DecodeString(initial)
+				if parts := strings.Split(string(b), "\x00"); len(parts) == 3 {
+					user = parts[1]
+				}
+			case "LOGIN":
+				user = readAuth("VXNlcm5hbWU6") // "Username:"
+				readAuth("UGFzc3dvcmQ6")        // "Password:"
+			default:
+				reply("504 unrecognized authentication type")
+				continue
+			}
+			reply("235 2.7.0 authentication successful")
+		case "MAIL":
+			from, _, _ = strings.Cut(strings.TrimPrefix(arg, "FROM:"), " ") // without the parameters, e.g. BODY=8BITMIME
+			to = nil
+			reply("250 OK")
+		case "RCPT":
+			to = append(to, strings.TrimPrefix(arg, "TO:"))
+			reply("250 OK")
+		case "DATA":
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			fmt.Printf("--- %s mail from %s to %s (user %q)\n%s\n", time.Now().Format(time.RFC3339), from, strings.Join(to, ", "), user, data)
+			reply("250 OK: queued")
+		case "RSET":
+			from, to = "", nil
+			reply("250 OK")
+		case "NOOP":
+			reply("250 OK")
+		case "STARTTLS":
+			reply("454 TLS not available")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Package metrics collects the metrics of the connector (polls, files and bytes transferred, connection state, ...)
+and exposes them in the Prometheus format, so that it can be told from outside whether the connector is healthy
+and how far behind it is.
+*/
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ftpc"
+
+// directions of the transfers
+const (
+	Download = "download" // from the FTP server
+	Upload   = "upload"   // to Cloud Storage
+)
+
+// the metrics labeled by server use the ID of the server (see utils.SourceID)
+var (
+	Polls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "polls_total",
+		Help: "Polls of the FTP server (listing of its files).",
+	}, []string{"server"})
+	PollErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "poll_errors_total",
+		Help: "Polls of the FTP server that failed (connection or listing errors).",
+	}, []string{"server"})
+	FilesDetected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "files_detected_total",
+		Help: "New files, or new versions of the files, found on the FTP server.",
+	}, []string{"server"})
+	FilesDownloaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "files_downloaded_total",
+		Help: "Files downloaded from the FTP server.",
+	}, []string{"server"})
+	FilesUploaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "files_uploaded_total",
+		Help: "Files uploaded to Cloud Storage.",
+	}, []string{"server"})
+	FilesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "files_failed_total",
+		Help: "Deliveries of a file that failed (they're retried in the next polls).",
+	}, []string{"server"})
+	BytesTransferred = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "bytes_transferred_total",
+		Help: "Bytes downloaded from the FTP server or uploaded to Cloud Storage.",
+	}, []string{"server", "direction"})
+	TransferDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Name: "transfer_duration_seconds",
+		Help:    "Duration of the downloads from the FTP server and of the uploads to Cloud Storage.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"server", "direction"})
+	Connected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Name: "server_connected",
+		Help: "Whether the connector is connected to the FTP server (1) or not (0).",
+	}, []string{"server"})
+	LastPoll = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Name: "last_successful_poll_timestamp_seconds",
+		Help: "Time of the last successful poll of the FTP server.",
+	}, []string{"server"})
+	LastUpload = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Name: "last_upload_timestamp_seconds",
+		Help: "Time of the last file of the server uploaded to Cloud Storage.",
+	}, []string{"server"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Polls, PollErrors, FilesDetected, FilesDownloaded, FilesUploaded, FilesFailed,
+		BytesTransferred, TransferDuration, Connected, LastPoll, LastUpload,
+	)
+}
+
+// Handler returns the handler of the /metrics endpoint
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+/*
+RegisterState registers the gauges computed when the metrics are collected: the length of the queue of the files
+waiting to be uploaded and whether the upload to Cloud Storage is enabled. It must be called only once.
+*/
+func RegisterState(queueLength func() int, uploadEnabled func() bool) {
+	registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "upload_queue_length",
+			Help: "Files waiting to be uploaded to Cloud Storage.",
+		}, func() float64 { return float64(queueLength()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "cloud_upload_enabled",
+			Help: "Whether the files are uploaded to Cloud Storage (1) or saved locally (0).",
+		}, func() float64 {
+			if uploadEnabled() {
+				return 1
+			}
+			return 0
+		}),
+	)
+}
+
+// Transferred records a file transferred in the given direction
+func Transferred(server, direction string, size int64, d time.Duration) {
+	BytesTransferred.WithLabelValues(server, direction).Add(float64(size))
+	TransferDuration.WithLabelValues(server, direction).Observe(d.Seconds())
+}
+
+// SetConnected sets the connection state of the server
+func SetConnected(server string, connected bool) {
+	v := 0.0
+	if connected {
+		v = 1
+	}
+	Connected.WithLabelValues(server).Set(v)
+}
+
+// InitServer creates the metrics of a server, so that they're exported (as 0) before anything happens
+func InitServer(server string) {
+	for _, c := range []*prometheus.CounterVec{Polls, PollErrors, FilesDetected, FilesDownloaded, FilesUploaded, FilesFailed} {
+		c.WithLabelValues(server)
+	}
+	for _, direction := range []string{Download, Upload} {
+		BytesTransferred.WithLabelValues(server, direction)
+	}
+	Connected.WithLabelValues(server)
+}
+
+// RemoveServer removes the metrics of a server (e.g. removed from the configuration)
+func RemoveServer(server string) {
+	for _, v := range []*prometheus.MetricVec{
+		Polls.MetricVec, PollErrors.MetricVec, FilesDetected.MetricVec, FilesDownloaded.MetricVec, FilesUploaded.MetricVec,
+		FilesFailed.MetricVec, BytesTransferred.MetricVec, TransferDuration.MetricVec, Connected.MetricVec,
+		LastPoll.MetricVec, LastUpload.MetricVec,
+	} {
+		v.DeletePartialMatch(prometheus.Labels{"server": server})
+	}
+}
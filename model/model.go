@@ -1,35 +1,83 @@
 package model
 
 import (
-	"context"
-	"errors"
-	"fmt"
-	"ftp-client/utils"
-	"io"
-	"log"
-	"os"
-	"sync"
+	"encoding/json"
 	"time"
-
-	"cloud.google.com/go/storage"
-	"google.golang.org/api/option"
 )
 
 type Log struct {
-	Size    int `json:"size"`
-	Backups int `json:"backups"`
-	Age     int `json:"age"`
+	Size    int    `json:"size"`
+	Backups int    `json:"backups"`
+	Age     int    `json:"age"`
+	Level   string `json:"level,omitempty"`  // debug, info (default), warn or error
+	Format  string `json:"format,omitempty"` // text (default) or json
+}
+
+type Compression struct {
+	Algorithm string `json:"algorithm"`
+	Level     int    `json:"level"`
+}
+
+type Encryption struct {
+	KeyFile string `json:"key_file"`
+	KeyID   string `json:"key_id"`
+}
+
+type PostAction struct {
+	Action      string `json:"action"`
+	ArchiveDir  string `json:"archive_dir"`
+	Suffix      string `json:"suffix"`
+	DryRun      bool   `json:"dry_run"`
+	MaxPerCycle int    `json:"max_per_cycle"`
+}
+
+type Push struct {
+	LocalDir      string `json:"local_dir"`
+	BucketPrefix  string `json:"bucket_prefix"`
+	FileExtension string `json:"file_ext"`
+}
+
+type Mirror struct {
+	MissingListings     int    `json:"missing_listings"`
+	Local               string `json:"local"`
+	LocalArchiveDir     string `json:"local_archive_dir"`
+	Bucket              string `json:"bucket"`
+	BucketArchivePrefix string `json:"bucket_archive_prefix"`
+}
+
+// Window is a time window repeated on the given days, e.g. mon-fri from 06:00 to 22:00
+type Window struct {
+	Days  string `json:"days"`  // e.g. "mon-fri", "sat,sun" (empty or "*": every day)
+	Start string `json:"start"` // HH:MM
+	End   string `json:"end"`   // HH:MM (before start: the window ends the next day; "24:00": midnight)
+}
+
+type Schedule struct {
+	Cron      string   `json:"cron,omitempty"`      // cron expression of the polls (if empty, "sampling" is the interval)
+	Timezone  string   `json:"timezone,omitempty"`  // IANA time zone of the cron expression and of the windows (default: local)
+	Windows   []Window `json:"windows,omitempty"`   // if set, the server is polled only inside these windows
+	Blackouts []Window `json:"blackouts,omitempty"` // the server is never polled (nor connected) inside these windows
 }
 
 type Server struct {
+	ID              string `json:"id,omitempty"` // unique ID of the server (derived from host, port, user and dir_path if not set)
 	Host            string `json:"host"`
+	Port            int    `json:"port,omitempty"` // default 21
 	User            string `json:"user"`
-	Password        string `json:"password"`
+	Password        Secret `json:"password"`
 	ServerName      string `json:"server_name"`
 	DirPath         string `json:"dir_path"`
 	FileExtension   string `json:"file_ext"`
 	Sampling        int    `json:"sampling"`
 	RetryConnection int    `json:"retry_conn"`
+
+	Compression *Compression `json:"compression,omitempty"`
+	Encryption  *Encryption  `json:"encryption,omitempty"`
+	PostAction  *PostAction  `json:"post_action,omitempty"`
+	Direction   string       `json:"direction,omitempty"`
+	Push        *Push        `json:"push,omitempty"`
+	Mirror      *Mirror      `json:"mirror,omitempty"`
+	Schedule    *Schedule    `json:"schedule,omitempty"`
 }
 
 type CloudStorage struct {
@@ -41,201 +89,128 @@ type CloudStorage struct {
 	RetryUpload        int    `json:"retry_upload"`
 	FileUploadAttempts int    `json:"file_upload_attempts"`
 	ConnectionAttempts int    `json:"connection_attempts"`
+	CreateOnly         bool   `json:"create_only"`
+	ChunkSize          int    `json:"chunk_size"`
+	UploadTimeout      int    `json:"upload_timeout"`
+	MinThroughput      int    `json:"min_throughput"`
+	MaxResumes         int    `json:"max_resumes"`
+
+	Compression *Compression `json:"compression,omitempty"`
 }
 
-type Config struct {
-	Servers      []Server     `json:"servers"`
-	Log          Log          `json:"log"`
-	CloudStorage CloudStorage `json:"cloud_storage"`
+type State struct {
+	Backend      string `json:"backend"` // "bolt" (default) or "json"
+	Path         string `json:"path"`    // file of the state (default: log/state.db or log/log.json)
+	HistoryLimit int    `json:"history_limit"`
 }
 
-/* CLOUD STORAGE OBJECTS */
-// client uploader to cloud storage
-type ClientCloudStorage struct {
-	Client     *storage.Client
-	ProjectID  string
-	BucketName string
-	UploadPath string
+// HTTP is the configuration of the HTTP server of the connector (the /metrics, health and admin endpoints)
+type HTTP struct {
+	Listen     string `json:"listen,omitempty"`      // address of the server, e.g. ":9090" (if empty, the server is not started)
+	StaleAfter int    `json:"stale_after,omitempty"` // [ms] delay of the polls after which a server is not ready
+	AdminToken Secret `json:"admin_token,omitempty"` // token of the admin API (if empty, the API is disabled)
+	Public     bool   `json:"public,omitempty"`      // serve the metrics and the dashboard without the token
 }
 
-// the structure of the file that will be uploaded
-type FileToUpload struct {
-	Data         []byte // bytes read from file downloaded from FTP server
-	Filename     string // cloud storage object's name
-	OriginalName string // filename as the original retrieved from FTP server
-	Host         string // host IP (used to save the object at the Host folder created in the bucket)
-	ServerName   string // the "resolved" name of the Host
+// Webhook is an HTTP endpoint to which the events of the connector are sent (see package webhooks)
+type Webhook struct {
+	URL         string   `json:"url"`
+	Secret      Secret   `json:"secret,omitempty"`       // key of the HMAC-SHA256 signature of the payloads (can be a secret reference)
+	Events      []string `json:"events,omitempty"`       // types of the events sent (if empty, all of them)
+	Timeout     int      `json:"timeout,omitempty"`      // [ms] timeout of a request
+	MaxAttempts int      `json:"max_attempts,omitempty"` // attempts to deliver an event
+	Retry       int      `json:"retry,omitempty"`        // [ms] delay before the first retry, doubled at every attempt
 }
 
-/*
-NewClientCloudStorage will initialize a new ClientCloudStorage object with the given parameters
-The return values are the Cloud Storage client and the error.
-At most N=cs.ConnectionAttempts attempts of client initialization will be performed.
-If all the attempts fail, it returns (nil,error). Otherwise it returns (client, nil)
-If error != nil is returned, the FTP files will be stored locally and not uploaded to the cloud.
-*/
-func NewClientCloudStorage(cs CloudStorage, logger *log.Logger) (*ClientCloudStorage, error) {
-	i := 0
-	for {
-		client, err := storage.NewClient(context.Background(), option.WithCredentialsFile(cs.CredentialsPath))
-		fmt.Printf("[CloudStorage] client created: %+v\n", client)
-
-		if err != nil {
-			fmt.Println("Error init client cloud storage: ", err)
-			if i == cs.ConnectionAttempts {
-				fmt.Println("Max retry connection attempts. Returning invalid cloud storage client")
-				logger.Printf("[Cloud Storage Client] Max retry connection attempts. All attempts failed creating Cloud Storage client")
-				err = errors.New("all attempts failed creating Cloud Storage client")
-				return nil, err
-			}
-		} else {
-			return &ClientCloudStorage{client, cs.ProjectID, cs.BucketName, cs.UploadPath}, nil
-		}
-		i++
-		time.Sleep(time.Duration(cs.RetryConnection) * time.Millisecond)
-	}
+// security of the connection to the SMTP server
+const (
+	SMTPStartTLS = "starttls" // plain connection upgraded with STARTTLS (default, usually port 587)
+	SMTPTLS      = "tls"      // implicit TLS (usually port 465)
+	SMTPNone     = "none"     // no encryption (e.g. a local relay)
+)
 
+// SMTP is the configuration of the mail server used to send the alerts (see package alerts)
+type SMTP struct {
+	Host       string `json:"host"`
+	Port       int    `json:"port,omitempty"`         // default 587 (465 with the tls security)
+	User       string `json:"user,omitempty"`         // if empty, no authentication
+	Password   Secret `json:"password,omitempty"`     // can be a secret reference
+	From       string `json:"from"`                   // sender, e.g. "FTP connector <ftpc@example.com>"
+	Security   string `json:"security,omitempty"`     // starttls (default), tls or none
+	Timeout    int    `json:"timeout,omitempty"`      // [ms] timeout of the delivery of a mail
+	MaxPerHour int    `json:"max_per_hour,omitempty"` // max mails sent in an hour (the others are dropped)
 }
 
-/*
-UploadFile will upload the given file (passed as parameter) to the cloud storage
-object with the same name as the file
-*/
-func (c *ClientCloudStorage) UploadFile(file FileToUpload) error {
-	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, time.Second*50)
-	defer cancel()
-
-	// Upload the file to a cloud storage object https://adityarama1210.medium.com/simple-golang-api-uploader-using-google-cloud-storage-3d5e45df74a5
-	filePath := fmt.Sprintf("%s/%s/%s", c.UploadPath, file.ServerName, file.Filename) // example path in bucket: FTP/<host-IP>/<filename.ext>
-	wc := c.Client.Bucket(c.BucketName).Object(filePath).NewWriter(ctx)
-	if _, err := wc.Write(file.Data); err != nil {
-		return fmt.Errorf("io.Copy: %v", err)
-	}
-	if err := wc.Close(); err != nil {
-		return fmt.Errorf("Writer.Close: %v", err)
-	}
-	return nil
+// Alert is a rule of the email alerts: the outage of the given type lasting longer than After is notified to To
+type Alert struct {
+	Name        string   `json:"name,omitempty"`         // name of the rule, in the logs and in the mails
+	Event       string   `json:"event"`                  // type of the outage: server_unreachable or upload_disabled
+	Servers     []string `json:"servers,omitempty"`      // IDs of the servers of the rule (if empty, all of them)
+	After       int      `json:"after,omitempty"`        // [ms] duration of the outage before the alert is sent
+	To          []string `json:"to"`                     // recipients
+	MinInterval int      `json:"min_interval,omitempty"` // [ms] min time between two alerts of the rule for the same server
 }
 
-/*
-CloudStorageUpload will forever read from the given channel and extract the file that needs to
-uploaded to the Cloud Storage bucket. The first time an upload, for a given file, fails N times in a row
-(where N is set as the env. var UPLOAD_ATTEMPTS), from now on all the files will be stored locally
-and not uploaded to cloud.
+type Config struct {
+	Servers      []Server     `json:"servers"`
+	Log          Log          `json:"log"`
+	CloudStorage CloudStorage `json:"cloud_storage"`
+	Encryption   *Encryption  `json:"encryption,omitempty"`
+	State        State        `json:"state"`
+	HTTP         HTTP         `json:"http"`
+	Webhooks     []Webhook    `json:"webhooks,omitempty"`
+	SMTP         *SMTP        `json:"smtp,omitempty"`
+	Alerts       []Alert      `json:"alerts,omitempty"`
+}
 
-Those files there were already in the channel (sent from the other FTP client) will not be uploaded
-but indeed stored locally.
-The upload pointer param is used to inform the other gorotuines whether to send file to the channel (to be later uploaded)
-or to store it locally.
+/* STATE OBJECTS */
+// FileInfo is the state of a file tracked on an FTP server (saved in the state store)
+type FileInfo struct {
+	Timestamp uint64 `json:"timestamp"`          // timestamp of the latest version found ("seen")
+	Delivered uint64 `json:"delivered"`          // timestamp of the latest version whose delivery was confirmed
+	Missing   int    `json:"missing,omitempty"`  // consecutive listings the file wasn't found in
+	Deleted   int64  `json:"deleted,omitempty"`  // tombstone: when the file was found deleted from the server (unix time)
+	Archived  bool   `json:"archived,omitempty"` // the file was removed from the server by the post-transfer action
 
-This function accepts a logger as a parameter that is used to log the info about the upload of a file
-*/
-func CloudStorageUpload(ch <-chan FileToUpload, wg *sync.WaitGroup, client *ClientCloudStorage, m *sync.Mutex, upload *bool, cs CloudStorage, logger *log.Logger) {
-	defer wg.Done()
-	fmt.Println("[GOROUTINE UPLOAD FILE STARTED]")
-	for {
-		// get the file
-		for obj := range ch {
-			attempts := 1 // file upload attempts
-			for {
-				fmt.Printf("**** Uploading file %s/%s\n", obj.ServerName, obj.Filename)
-				//filename :=  // path is: host/file.ext
-				err := client.UploadFile(obj)
-				if err != nil {
-					fmt.Printf("[%s] Error uploading file %s: %s\n", obj.ServerName, obj.Filename, err)
-					logger.Printf("[%s] Error uploading file %s\n", obj.ServerName, obj.OriginalName)
-					if attempts == cs.FileUploadAttempts {
-						// close this goroutine and start saving files locally
-						fmt.Println("[Goroutine] MAX UPlOAD ATTEMPTS reached. Closing goroutine")
-						logger.Printf("[%s] Max upload attempts reached. Upload to Cloud Storage is disabled\n", obj.ServerName)
-						// tells the other goroutines to save files locally
-						m.Lock()
-						*upload = false
-						m.Unlock()
-
-						/* retrieve all the files in the channel and save them locally */
-						fmt.Println("--- TOTAL files in channels: ", len(ch))
-						filesToSaveLocally := make(map[string][]string)
-						// save the current file and get the others
-						filesToSaveLocally[obj.ServerName] = append(filesToSaveLocally[obj.ServerName], obj.OriginalName)
-						getAllFilesFromChannel(ch, filesToSaveLocally)
-						fmt.Printf("____ AllFiles: %v\n", filesToSaveLocally)
-						wg.Add(1)
-						go saveFilesLocallyFromChannel(wg, filesToSaveLocally, logger)
-						return
-					}
-					attempts++
-					time.Sleep(time.Duration(cs.RetryUpload) * time.Millisecond)
-				} else {
-					logger.Printf("[%s] File %s (%s) uploaded successfully\n", obj.ServerName, obj.OriginalName, obj.Filename)
-					fmt.Printf("File %s (%s) uploaded successfully\n", obj.OriginalName, obj.Filename)
-					break
-				}
-			}
-		}
-	}
+	Versions []Version `json:"versions,omitempty"` // history of the versions found (the oldest first)
 }
 
-/*
-Get all the files from the channel (that were inserted into it before the upload to Cloud Storage failed) and save them in the map.
-That map will be used later on to retrieve the info of the file that needs to be downloaded.
-*/
-func getAllFilesFromChannel(ch <-chan FileToUpload, m map[string][]string) {
-	for f := range ch {
-		fmt.Println("___ retrieved file: ", f.Filename)
-		m[f.ServerName] = append(m[f.ServerName], f.OriginalName)
-		if len(ch) == 0 {
-			return
-		}
-	}
+// Version is a version of a tracked file found on the FTP server
+type Version struct {
+	DetectedAt   time.Time `json:"detected_at"`            // when the version was found
+	Timestamp    uint64    `json:"timestamp"`              // timestamp of the file on the FTP server
+	Size         uint64    `json:"size"`                   // size of the file on the FTP server
+	Hash         string    `json:"hash,omitempty"`         // SHA-256 of the file (before compression and encryption)
+	Destinations []string  `json:"destinations,omitempty"` // where the version was delivered (object URL or local path)
+	Status       string    `json:"status"`                 // delivery status: detected, delivered, failed or conflict
+	Error        string    `json:"error,omitempty"`        // error of the last failed delivery
 }
 
 /*
-saveFilesLocallyFromChannel saves all the files found for each host (saved in the map parameter)
-locally. Those files are the ones that were previously send in the channel and need to be
-manually saved (since this function will execute when the upload to cloud storage is disabled by some errors)
+UnmarshalJSON decodes the state of a file. Before the FileInfo object was introduced only the timestamp of the
+file was saved, so a plain number is accepted as well.
+The states saved before the delivered timestamp was introduced recorded a version as soon as it was found:
+their latest version is considered delivered, so that it's not transferred again.
 */
-func saveFilesLocallyFromChannel(wg *sync.WaitGroup, m map[string][]string, logger *log.Logger) {
-	defer wg.Done()
-	//clientsConf := ConfigureClients()
-	clientsConf := utils.LoadConfiguration("auth/conf.json").Servers
-	// loop over map, find the right ClientConfig (in the slice) and get the username, pwd, .. for this client
-	for serverName := range m {
-		for _, clientConf := range clientsConf {
-			if serverName == clientConf.ServerName {
-				fmt.Printf("[%s] Saving files for server %s\n", serverName, clientConf.ServerName)
-				// create new FTP client
-				ftpClient, err := utils.NewClientFTP(clientConf, logger)
-				if err != nil {
-					fmt.Println("---- ERROR creating client")
-				}
-
-				// loop over the files (saved for this client) and download each one
-				for _, filename := range m[serverName] {
-					reader, err := ftpClient.Retr(filename)
-					if err != nil {
-						fmt.Printf("[NEW GOROUTINE for %s] Error pulling file %s: %s\n", clientConf.ServerName, filename, err)
-						logger.Printf("[%s] Error pulling file %s: %s\n", clientConf.ServerName, filename, err)
-					}
-					outFile, err := os.Create("./files/" + clientConf.ServerName + "/" + filename)
-					if err != nil {
-						fmt.Printf("[NEW GOROUTINE for %s] Error creating local file %s: %s\n", clientConf.ServerName, filename, err)
-						logger.Printf("[%s] Error creating local file %s\n", clientConf.ServerName, filename, err)
-					}
-					_, err = io.Copy(outFile, reader)
-					if err != nil {
-						fmt.Printf("[NEW GOROUTINE for %s] Error copying data to local file %s: %s\n", clientConf.ServerName, filename, err)
-						logger.Printf("[%s] Error copying data to local file %s\n", clientConf.ServerName, filename, err)
-					}
-
-					fmt.Printf("[NEW GOROUTINE for %s] File %s successfully downloaded \n", clientConf.ServerName, filename)
-					logger.Printf("[%s] File %s successfully downloaded\n", clientConf.ServerName, filename)
-					outFile.Close()
-					reader.Close()
-				}
-			}
-
-		}
+func (f *FileInfo) UnmarshalJSON(b []byte) error {
+	var timestamp uint64
+	if err := json.Unmarshal(b, &timestamp); err == nil {
+		*f = FileInfo{Timestamp: timestamp, Delivered: timestamp}
+		return nil
+	}
+	type fileInfo FileInfo // avoid the recursion
+	aux := struct {
+		*fileInfo
+		Delivered *uint64 `json:"delivered"`
+	}{fileInfo: (*fileInfo)(f)}
+	*f = FileInfo{}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
 	}
+	if aux.Delivered != nil {
+		f.Delivered = *aux.Delivered
+	} else {
+		f.Delivered = f.Timestamp
+	}
+	return nil
 }
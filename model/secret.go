@@ -0,0 +1,105 @@
+package model
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+/*
+Prefixes of the secret references, which can be used in place of the password of a server, of the credentials
+of Cloud Storage, of the token of the admin API, of the secrets of the webhooks and of the password of the SMTP server
+(see utils.ResolveSecret):
+  - env:NAME reads the secret from the environment variable NAME
+  - file:/run/secrets/x reads the secret from the file (e.g. a Docker secret)
+  - netrc (or netrc:/path/to/netrc) reads the password of the server's host and user from the netrc file
+*/
+const (
+	SecretEnv   = "env:"
+	SecretFile  = "file:"
+	SecretNetrc = "netrc"
+)
+
+// placeholder of the secrets in the logs
+const Redacted = "[REDACTED]"
+
+// IsSecretRef reports whether the value is a reference to a secret (and not the secret itself)
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, SecretEnv) || strings.HasPrefix(value, SecretFile) ||
+		value == SecretNetrc || strings.HasPrefix(value, SecretNetrc+":")
+}
+
+/*
+RedactSecret returns the value to log in place of a secret: a reference is kept (it says where the secret comes from,
+not what it is), a plain secret is replaced with Redacted.
+*/
+func RedactSecret(value string) string {
+	if value == "" || IsSecretRef(value) {
+		return value
+	}
+	return Redacted
+}
+
+/*
+Secret is a password, a token or a key of the configuration (or a reference to it, see IsSecretRef), redacted
+wherever it's printed (see RedactSecret): by fmt, also as a field of a struct (%v, %+v and %#v), by log/slog and
+by encoding/json. Its value is read with string(s), e.g. by utils.ResolveSecret.
+*/
+type Secret string
+
+// String returns the secret redacted
+func (s Secret) String() string {
+	return RedactSecret(string(s))
+}
+
+// GoString is used by %#v: the secret is redacted as well
+func (s Secret) GoString() string {
+	return strconv.Quote(s.String())
+}
+
+// LogValue is used by log/slog: the secret is redacted
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+// MarshalText is used by encoding/json (e.g. the JSON format of the logs): the secret is redacted
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+type server Server // same fields, without the methods (avoids the recursion)
+
+// String returns the server with the password redacted, so that it's never printed
+func (s Server) String() string {
+	return fmt.Sprintf("%+v", server(s))
+}
+
+// LogValue is used by log/slog: the password is redacted
+func (s Server) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("id", s.ID),
+		slog.String("host", s.Host),
+		slog.Int("port", s.Port),
+		slog.String("user", s.User),
+		slog.Any("password", s.Password),
+		slog.String("server_name", s.ServerName),
+		slog.String("dir_path", s.DirPath),
+		slog.String("file_ext", s.FileExtension),
+		slog.Int("sampling", s.Sampling),
+		slog.String("direction", s.Direction),
+	)
+}
+
+/*
+LogValue is used by log/slog: the main settings of Cloud Storage. The credentials_path is logged as it is:
+it's the path of the credentials (or a secret reference), not the credentials themselves.
+*/
+func (c CloudStorage) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("credentials_path", c.CredentialsPath),
+		slog.String("project_id", c.ProjectID),
+		slog.String("bucket_name", c.BucketName),
+		slog.String("upload_path", c.UploadPath),
+	)
+}
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSecretRedacted(t *testing.T) {
+	const password = "pa55w0rd"
+	server := Server{ID: "line3", Host: "10.10.0.1", User: "ftp", Password: password}
+	config := Config{
+		Servers:      []Server{server, {ID: "line4", Password: "env:LINE4_PASSWORD"}},
+		CloudStorage: CloudStorage{CredentialsPath: "/run/secrets/gcs.json"},
+		HTTP:         HTTP{AdminToken: password},
+		Webhooks:     []Webhook{{URL: "https://example.com/hooks", Secret: password}},
+		SMTP:         &SMTP{Host: "smtp.example.com", Password: password},
+	}
+
+	var text, js bytes.Buffer
+	slog.New(slog.NewTextHandler(&text, nil)).Info("test", "server", server, "config", config, "password", server.Password)
+	slog.New(slog.NewJSONHandler(&js, nil)).Info("test", "server", server, "config", config, "password", server.Password)
+	marshaled, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := map[string]string{
+		"%v":           fmt.Sprintf("%v", config),
+		"%+v":          fmt.Sprintf("%+v", config),
+		"%#v":          fmt.Sprintf("%#v", config),
+		"String":       server.String(),
+		"slog text":    text.String(),
+		"slog JSON":    js.String(),
+		"json.Marshal": string(marshaled),
+	}
+	for name, out := range outputs {
+		if strings.Contains(out, password) {
+			t.Errorf("%s: the secret is printed: %s", name, out)
+		}
+		if !strings.Contains(out, Redacted) {
+			t.Errorf("%s: %s missing: %s", name, Redacted, out)
+		}
+	}
+	// the references and the paths say where the secrets are, not what they are
+	for _, name := range []string{"%+v", "slog text", "slog JSON"} {
+		for _, want := range []string{"env:LINE4_PASSWORD", "/run/secrets/gcs.json"} {
+			if !strings.Contains(outputs[name], want) {
+				t.Errorf("%s: %q missing: %s", name, want, outputs[name])
+			}
+		}
+	}
+	if got := string(server.Password); got != password {
+		t.Errorf("string(Password) = %q, want the secret", got)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"ftp-client/events"
+	"ftp-client/model"
+	"ftp-client/state"
+	"ftp-client/utils"
+	"ftp-client/webhooks"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// exit codes of the once command
+const (
+	onceSuccess = 0 // all the servers were synced without errors
+	oncePartial = 1 // some servers or files failed
+	onceFailure = 2 // nothing could be synced (or the connector couldn't start)
+)
+
+// statuses of the summary of the once command
+const (
+	statusSuccess = "success"
+	statusPartial = "partial"
+	statusFailure = "failure"
+)
+
+// default time allowed for the pass over each server in once mode (the connection and the uploads)
+const defaultOnceTimeout = 10 * time.Minute
+
+// time allowed to deliver the events queued for the webhooks, before exiting
+const webhooksCloseTimeout = 30 * time.Second
+
+// serverReport is the outcome of the single pass over a server (once mode)
+type serverReport struct {
+	mu          sync.Mutex
+	ID          string `json:"id"`
+	ServerName  string `json:"server_name,omitempty"`
+	Found       int    `json:"found"`             // files on the server to track (matching file_ext)
+	Transferred int    `json:"transferred"`       // versions delivered
+	Failed      int    `json:"failed"`            // versions whose delivery failed
+	Error       string `json:"error,omitempty"`   // error that stopped the pass (e.g. the server is unreachable)
+	Skipped     string `json:"skipped,omitempty"` // why the server was not polled (e.g. a blackout window)
+}
+
+// the methods are no-ops on a nil report, which is the one of the servers run continuously
+
+func (r *serverReport) found() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.Found++
+	r.mu.Unlock()
+}
+
+func (r *serverReport) delivered(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if err == nil {
+		r.Transferred++
+	} else {
+		r.Failed++
+	}
+	r.mu.Unlock()
+}
+
+func (r *serverReport) fail(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.Error = err.Error()
+	r.mu.Unlock()
+}
+
+func (r *serverReport) skip(reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.Skipped = reason
+	r.mu.Unlock()
+}
+
+// failed reports whether nothing of the server could be synced
+func (r *serverReport) failed() bool {
+	return r.Error != "" || (r.Failed > 0 && r.Transferred == 0)
+}
+
+// onceSummary is the summary printed (as JSON) by the once command
+type onceSummary struct {
+	Status      string          `json:"status"` // success, partial or failure
+	StartedAt   time.Time       `json:"started_at"`
+	FinishedAt  time.Time       `json:"finished_at"`
+	Found       int             `json:"found"`
+	Transferred int             `json:"transferred"`
+	Failed      int             `json:"failed"`
+	Servers     []*serverReport `json:"servers"`
+	Error       string          `json:"error,omitempty"` // error that prevented the pass (e.g. an invalid configuration)
+}
+
+/*
+onceCommand runs a single pass over the servers (all of them, or the ones given): the files are listed and the new
+versions are transferred, then the command waits for the uploads to be confirmed, saves the state and exits.
+It's meant for the sites that are connected only in some windows, where the command is run by cron or a batch scheduler.
+Usage: once [-timeout d] [server ...]
+The summary (files found, transferred and failed for each server) is printed as JSON to stdout, while the
+messages of the connector are written to stderr. The exit code is 0 if everything was synced, 1 if some servers or
+files failed and 2 if nothing could be synced.
+*/
+func onceCommand(args []string) int {
+	fs := flag.NewFlagSet("once", flag.ExitOnError)
+	timeout := fs.Duration("timeout", defaultOnceTimeout, "time allowed for the pass over each server (the connection and the uploads)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: once [-timeout d] [server id or server_name ...] (default: all the servers)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	// stdout is left to the summary, so that it can be parsed: the messages of the connector go to stderr
+	utils.SetLogConsole(os.Stderr)
+
+	summary := onceSummary{StartedAt: time.Now().UTC(), Servers: []*serverReport{}}
+	// abort prints the summary of a pass that couldn't start
+	abort := func(msg string, err error) int {
+		fmt.Fprintln(os.Stderr, msg, err)
+		summary.Status, summary.FinishedAt, summary.Error = statusFailure, time.Now().UTC(), fmt.Sprintf("%s %s", msg, err)
+		printSummary(os.Stdout, summary)
+		return onceFailure
+	}
+	config, err := utils.LoadConfiguration(configFile)
+	if err != nil {
+		return abort("Invalid configuration:", err)
+	}
+	servers := config.Servers
+	if fs.NArg() > 0 {
+		servers = nil
+		for _, name := range fs.Args() {
+			conf, ok := findServer(config.Servers, name)
+			if !ok {
+				return abort("Unknown server:", errors.New(name))
+			}
+			servers = append(servers, conf)
+		}
+	}
+
+	utils.CheckDirectory(utils.LogDir)
+	utils.CheckDirectory(utils.DataDir)
+	utils.CheckDirectory(utils.StateDirectory())
+	mainLogger := utils.InitLogger(config, "main")
+	slog.SetDefault(mainLogger)
+	events.Subscribe(events.NewJSONWriter(utils.NewLogWriter(config, "events")))
+	hooks := webhooks.New(config.Webhooks)
+	events.Subscribe(hooks.Notify)
+
+	store, err := state.Open(config.State, utils.StateDirectory())
+	if err != nil {
+		return abort("Error opening the state:", err)
+	}
+	defer store.Close()
+	if err := utils.MigrateStateKeys(store, config.Servers); err != nil {
+		return abort("Error migrating the state:", err)
+	}
+
+	clientCloudStorage, err := utils.NewClientCloudStorage(config.CloudStorage, mainLogger)
+	if err != nil {
+		mainLogger.Error("Error creating the Cloud Storage client: the files are saved locally", "error", err)
+	}
+	cloud := utils.NewCloudSettings(clientCloudStorage, config.CloudStorage)
+	cloud.SetConfig(config)
+	fileChannel := make(chan utils.FileToUpload, 20)
+	// the uploader runs until the process exits: every file sent to it is confirmed before the watchers return
+	go utils.CloudStorageUpload(fileChannel, &sync.WaitGroup{}, cloud, mainLogger)
+
+	wg := &sync.WaitGroup{}
+	for _, conf := range servers {
+		id := utils.SourceID(conf)
+		report := &serverReport{ID: id, ServerName: conf.ServerName}
+		summary.Servers = append(summary.Servers, report)
+		utils.CheckDirectory(utils.LocalDir(id))
+		logger := utils.ServerLogger(config, conf)
+		wg.Add(1)
+		go func(conf model.Server) {
+			defer wg.Done()
+			// the connection is retried, and the uploads waited for, until the timeout: then the server is reported as failed
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			defer cancel()
+			watchServer(ctx, conf, config, logger, store, fileChannel, cloud, nil, nil, report)
+		}(conf)
+	}
+	wg.Wait()
+	if err := store.Flush(); err != nil {
+		mainLogger.Error("Error saving the state", "error", err)
+	}
+	// the events of the pass are delivered to the webhooks before exiting
+	if !hooks.Close(webhooksCloseTimeout) {
+		mainLogger.Warn("Timeout delivering the webhooks: some events were not delivered")
+	}
+
+	code := summarize(&summary)
+	summary.FinishedAt = time.Now().UTC()
+	printSummary(os.Stdout, summary)
+	return code
+}
+
+// printSummary writes the summary as JSON to out
+func printSummary(out io.Writer, summary onceSummary) {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	enc.Encode(summary)
+}
+
+// summarize computes the totals and the status of the summary, and returns the exit code
+func summarize(summary *onceSummary) int {
+	failed := 0
+	clean := true
+	for _, r := range summary.Servers {
+		summary.Found += r.Found
+		summary.Transferred += r.Transferred
+		summary.Failed += r.Failed
+		if r.failed() {
+			failed++
+		}
+		if r.Error != "" || r.Failed > 0 {
+			clean = false
+		}
+	}
+	switch {
+	case clean:
+		summary.Status = statusSuccess
+		return onceSuccess
+	case failed == len(summary.Servers):
+		summary.Status = statusFailure
+		return onceFailure
+	}
+	summary.Status = statusPartial
+	return oncePartial
+}
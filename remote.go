@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"ftp-client/model"
+	"ftp-client/utils"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// default time allowed to connect to an FTP server by the commands
+const defaultConnectTimeout = 30 * time.Second
+
+/*
+lsCommand lists the files on an FTP server of the configuration.
+Usage: ls [-timeout d] <server> [path], where path is relative to the dir_path of the server (default: dir_path itself).
+It returns the exit code of the command.
+*/
+func lsCommand(args []string) int {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	timeout := fs.Duration("timeout", defaultConnectTimeout, "time allowed to connect to the server")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: ls [-timeout d] <server id or server_name> [path]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	client, err := connectServer(fs.Arg(0), *timeout)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer client.Quit()
+	entries, err := client.List(fs.Arg(1))
+	if err != nil {
+		fmt.Println("Error listing the files: ", err)
+		return 1
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tSIZE\tMODIFIED\tNAME")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", e.Type, e.Size, e.Time.UTC().Format(time.RFC3339), e.Name)
+	}
+	w.Flush()
+	return 0
+}
+
+/*
+getCommand downloads a file from an FTP server of the configuration, as it is on the server (the compression and
+the encryption of the configuration are not applied).
+Usage: get [-timeout d] <server> <file> [output], where file is relative to the dir_path of the server.
+The output defaults to the name of the file in the current directory.
+It returns the exit code of the command.
+*/
+func getCommand(args []string) int {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	timeout := fs.Duration("timeout", defaultConnectTimeout, "time allowed to connect to the server")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: get [-timeout d] <server id or server_name> <file> [output]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 || fs.NArg() > 3 {
+		fs.Usage()
+		return 2
+	}
+	filename := fs.Arg(1)
+	output := path.Base(filename)
+	if fs.NArg() == 3 {
+		output = fs.Arg(2)
+	}
+
+	client, err := connectServer(fs.Arg(0), *timeout)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer client.Quit()
+	reader, err := client.Retr(filename)
+	if err != nil {
+		fmt.Printf("Error pulling file %s: %s\n", filename, err)
+		return 1
+	}
+	defer reader.Close()
+
+	out, err := os.Create(output)
+	if err != nil {
+		fmt.Println("Error creating the output file: ", err)
+		return 1
+	}
+	n, err := io.Copy(out, reader)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+		fmt.Printf("Error downloading file %s: %s\n", filename, err)
+		return 1
+	}
+	fmt.Printf("%s: %d bytes saved to %s\n", filename, n, output)
+	return 0
+}
+
+// connectServer connects to the FTP server with the given ID (or server_name) and changes to its dir_path
+func connectServer(name string, timeout time.Duration) (*ftp.ServerConn, error) {
+	config, err := utils.LoadConfiguration(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid configuration:\n%s", err)
+	}
+	conf, ok := findServer(config.Servers, name)
+	if !ok {
+		return nil, fmt.Errorf("Unknown server %s", name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// the commands don't write to the log files of the connector
+	client, err := utils.NewClientFTPContext(ctx, conf, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to %s: %s", name, err)
+	}
+	return client, nil
+}
+
+// findServer returns the server with the given ID or server_name (if unique)
+func findServer(servers []model.Server, name string) (model.Server, bool) {
+	id := resolveSourceID(servers, name)
+	for _, s := range servers {
+		if utils.SourceID(s) == id {
+			return s, true
+		}
+	}
+	return model.Server{}, false
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"ftp-client/alerts"
+	"ftp-client/events"
+	"ftp-client/metrics"
+	"ftp-client/state"
+	"ftp-client/utils"
+	"ftp-client/webhooks"
+	"log/slog"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// time allowed, when the connector is stopped, to upload the files queued and to send the alerts queued
+const (
+	uploadsCloseTimeout = time.Minute
+	alertsCloseTimeout  = 30 * time.Second
+)
+
+/*
+runCommand runs the connector: the files of the servers are tracked and delivered until the process is stopped,
+and the configuration is reloaded when it changes.
+Usage: run
+On SIGTERM or SIGINT the connector is stopped gracefully: the goroutines of the servers are stopped, then the files
+queued are uploaded, the events delivered to the webhooks and the alerts sent (each for a limited time), and the
+state is closed. It returns the exit code of the command: 0 once stopped, 1 if the connector can't start.
+*/
+func runCommand(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: run")
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	// load configuration file (auth/conf.json, or the YAML or TOML one, if -config is not set)
+	config, err := utils.LoadConfiguration(configFile)
+	if err != nil {
+		fmt.Printf("Invalid configuration:\n%s\n", err)
+		return 1
+	}
+
+	// first check if the necessary folders are present
+	utils.CheckDirectory(utils.LogDir)
+	utils.CheckDirectory(utils.DataDir)
+	utils.CheckDirectory(utils.StateDirectory())
+
+	// create the "main" logger (the one that is used also for logging the info about the upload of files)
+	mainLogger := utils.InitLogger(config, "main")
+	// the messages not bound to a server (e.g. the import of the state) are written by the main logger as well
+	slog.SetDefault(mainLogger)
+	// write the events (e.g. the files deleted from the servers in mirror mode) as JSON lines to <log dir>/events.log
+	events.Subscribe(events.NewJSONWriter(utils.NewLogWriter(config, "events")))
+	// send the events to the webhooks (e.g. the files delivered, the upload disabled, a server unreachable)
+	hooks := webhooks.New(config.Webhooks)
+	events.Subscribe(hooks.Notify)
+	// send the email alerts of the prolonged outages (a server unreachable, the upload disabled)
+	notifier := alerts.New(config)
+	events.Subscribe(notifier.Notify)
+
+	// the state of the files tracked for each server (an existing log.json is imported the first time)
+	store, err := state.Open(config.State, utils.StateDirectory())
+	if err != nil {
+		mainLogger.Error("Error opening the state", "error", err)
+		return 1
+	}
+	defer store.Close()
+	// the state saved by server_name (before the source IDs) is moved to the ID of the server
+	if err := utils.MigrateStateKeys(store, config.Servers); err != nil {
+		mainLogger.Error("Error migrating the state", "error", err)
+		return 1
+	}
+
+	mainLogger.Info("Starting the connector", "servers", len(config.Servers))
+
+	//  WaitGroup (for goroutines)
+	wg := &sync.WaitGroup{}
+	fileChannel := make(chan utils.FileToUpload, 20)
+
+	// Create the Cloud Storage client (if it fails, the files are saved locally)
+	clientCloudStorage, clientStorageErr := utils.NewClientCloudStorage(config.CloudStorage, mainLogger)
+	if clientStorageErr != nil {
+		mainLogger.Error("Error creating the Cloud Storage client: the files are saved locally", "error", clientStorageErr)
+	}
+	cloud := utils.NewCloudSettings(clientCloudStorage, config.CloudStorage)
+
+	// the goroutine of each server is started (and restarted or stopped when the configuration is reloaded) by the supervisor
+	sup := newSupervisor(configFile, store, fileChannel, cloud, hooks, notifier, mainLogger)
+	// the transfers are collected for the dashboard
+	events.Subscribe(sup.transfers.add)
+
+	// expose the metrics (the queue and the upload flag are read when they're collected) and the health endpoints
+	metrics.RegisterState(func() int { return len(fileChannel) }, cloud.UploadEnabled)
+	if err := serveHTTP(config.HTTP, sup, mainLogger); err != nil {
+		mainLogger.Error("Error starting the HTTP server", "error", err)
+		return 1
+	}
+	sup.apply(config)
+
+	/*
+		Start the gorotuine responsible to extract data from the channel, build out the file and upload it
+		to Cloud Storage (or save it locally, if the Cloud Storage client is not available)
+	*/
+	wg.Add(1)
+	go utils.CloudStorageUpload(fileChannel, wg, cloud, mainLogger)
+
+	// reload the configuration when the file changes (or on SIGHUP), until SIGTERM or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	sup.watchConfig(ctx)
+	stop() // a second signal kills the process
+	mainLogger.Info("Stopping the connector")
+
+	// the servers are stopped first, so that no file is sent to the uploader anymore
+	sup.stop()
+	close(fileChannel)
+	if !waitTimeout(wg, uploadsCloseTimeout) {
+		mainLogger.Warn("Timeout uploading the files queued: they're transferred again at the next start", "queued", len(fileChannel))
+	}
+	if !hooks.Close(webhooksCloseTimeout) {
+		mainLogger.Warn("Timeout delivering the webhooks: some events were not delivered")
+	}
+	if !notifier.Close(alertsCloseTimeout) {
+		mainLogger.Warn("Timeout sending the alerts: some mails were not sent")
+	}
+	// the state is closed last (deferred above)
+	mainLogger.Info("Connector stopped")
+	return 0
+}
+
+// waitTimeout waits for the wait group, at most for the timeout. It reports whether the wait group is done
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
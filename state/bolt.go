@@ -0,0 +1,256 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ftp-client/model"
+	"io"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+BoltStore is the state saved in an embedded bbolt database: each source is a bucket, each file a key with its
+info encoded as JSON. Every update is a transaction written to disk before returning, so the state survives
+a crash or a power cut.
+*/
+type BoltStore struct {
+	db       *bolt.DB
+	snapshot string // temporary copy opened instead of the database locked by the connector (see OpenSnapshot)
+}
+
+// errLocked is returned by OpenBolt when the database is locked by another process
+var errLocked = errors.New("locked")
+
+// attempts to copy a consistent snapshot of a database that is being written
+const snapshotAttempts = 5
+
+// OpenBolt opens (or creates) the database at the given path
+func OpenBolt(path string, readOnly bool) (*BoltStore, error) {
+	// the timeout avoids waiting forever if the database is locked by another process
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("state database %s is %w (is the connector running?)", path, errLocked)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening state database %s: %v", path, err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+/*
+OpenSnapshot opens a read-only copy of the database at the given path, which can be locked by the connector running
+(bbolt allows a single process). The file is copied to a temporary one, removed by Close: if it changed during
+the copy (a transaction was committed) or the copy isn't consistent, the copy is retried.
+*/
+func OpenSnapshot(path string) (*BoltStore, error) {
+	var err error
+	for attempt := 1; attempt <= snapshotAttempts; attempt++ {
+		var s *BoltStore
+		if s, err = openSnapshot(path); err == nil {
+			return s, nil
+		}
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("copying state database %s: %v", path, err)
+}
+
+func openSnapshot(path string) (*BoltStore, error) {
+	before, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp("", "ftpc-state-*.db")
+	if err != nil {
+		return nil, err
+	}
+	err = copyFile(tmp, path)
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		var after os.FileInfo
+		if after, err = os.Stat(path); err == nil && (!after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size()) {
+			err = errors.New("the database changed during the copy")
+		}
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	s, err := OpenBolt(tmp.Name(), true)
+	if err == nil {
+		err = s.db.View(func(tx *bolt.Tx) error {
+			var first error // the first problem found: the copy is retried
+			for cErr := range tx.Check() {
+				if first == nil {
+					first = cErr
+				}
+			}
+			return first
+		})
+		if err != nil {
+			s.db.Close()
+		}
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	s.snapshot = tmp.Name()
+	return s, nil
+}
+
+func copyFile(dst *os.File, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+func (s *BoltStore) Get(source, name string) (model.FileInfo, bool, error) {
+	var info model.FileInfo
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(source))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(v, &info)
+	})
+	return info, ok, err
+}
+
+func (s *BoltStore) Put(source, name string, info model.FileInfo) error {
+	return s.Update(source, name, func(i *model.FileInfo, ok bool) error {
+		*i = info
+		return nil
+	})
+}
+
+func (s *BoltStore) Update(source, name string, fn func(info *model.FileInfo, ok bool) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(source))
+		if err != nil {
+			return err
+		}
+		var info model.FileInfo
+		v := b.Get([]byte(name))
+		if v != nil {
+			if err := json.Unmarshal(v, &info); err != nil {
+				return err
+			}
+		}
+		if err := fn(&info, v != nil); err != nil {
+			return err
+		}
+		data, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), data)
+	})
+}
+
+// putAll saves all the files given (key: source, value: map(key: filename, value: info)) in a single transaction
+func (s *BoltStore) putAll(files map[string]map[string]model.FileInfo) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for source, infos := range files {
+			b, err := tx.CreateBucketIfNotExists([]byte(source))
+			if err != nil {
+				return err
+			}
+			for name, info := range infos {
+				data, err := json.Marshal(info)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(name), data); err != nil {
+					return err
+				}
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (s *BoltStore) Files(source string) (map[string]model.FileInfo, error) {
+	files := make(map[string]model.FileInfo)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(source))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var info model.FileInfo
+			if err := json.Unmarshal(v, &info); err != nil {
+				return err
+			}
+			files[string(k)] = info
+			return nil
+		})
+	})
+	return files, err
+}
+
+func (s *BoltStore) Sources() ([]string, error) {
+	var sources []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			sources = append(sources, string(name))
+			return nil
+		})
+	})
+	return sources, err
+}
+
+func (s *BoltStore) RenameSource(from, to string) (bool, error) {
+	moved := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		src := tx.Bucket([]byte(from))
+		if src == nil || from == to {
+			return nil
+		}
+		if dst := tx.Bucket([]byte(to)); dst != nil {
+			if k, _ := dst.Cursor().First(); k != nil {
+				return nil // the new source already has its own files
+			}
+		}
+		dst, err := tx.CreateBucketIfNotExists([]byte(to))
+		if err != nil {
+			return err
+		}
+		if err := src.ForEach(func(k, v []byte) error { return dst.Put(k, v) }); err != nil {
+			return err
+		}
+		moved = true
+		return tx.DeleteBucket([]byte(from))
+	})
+	return moved, err
+}
+
+func (s *BoltStore) Flush() error {
+	return nil
+}
+
+func (s *BoltStore) Close() error {
+	err := s.db.Close()
+	if s.snapshot != "" {
+		os.Remove(s.snapshot)
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"ftp-client/model"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+JSONStore is the state kept in memory and saved as a single JSON file (the legacy log.json).
+The file is rewritten by Flush only if something changed, and atomically (a temporary file is written, synced
+and renamed over the old one), so a crash during the write never leaves a truncated file.
+*/
+type JSONStore struct {
+	path  string
+	mu    sync.Mutex
+	files map[string]map[string]model.FileInfo // key: source, value: map(key: filename, value: info)
+	dirty bool
+}
+
+// OpenJSON loads the state from the JSON file at the given path (a missing file is an empty state)
+func OpenJSON(path string) (*JSONStore, error) {
+	s := &JSONStore{path: path, files: make(map[string]map[string]model.FileInfo)}
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &s.files); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", path, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *JSONStore) Get(source, name string) (model.FileInfo, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.files[source][name]
+	return info, ok, nil
+}
+
+func (s *JSONStore) Put(source, name string, info model.FileInfo) error {
+	return s.Update(source, name, func(i *model.FileInfo, ok bool) error {
+		*i = info
+		return nil
+	})
+}
+
+func (s *JSONStore) Update(source, name string, fn func(info *model.FileInfo, ok bool) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.files[source][name]
+	// the versions are copied, so that a failed update doesn't modify the ones in the map
+	info.Versions = append([]model.Version(nil), info.Versions...)
+	if err := fn(&info, ok); err != nil {
+		return err
+	}
+	if _, ok := s.files[source]; !ok {
+		s.files[source] = map[string]model.FileInfo{}
+	}
+	s.files[source][name] = info
+	s.dirty = true
+	return nil
+}
+
+func (s *JSONStore) Files(source string) (map[string]model.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make(map[string]model.FileInfo, len(s.files[source]))
+	for name, info := range s.files[source] {
+		files[name] = info
+	}
+	return files, nil
+}
+
+func (s *JSONStore) Sources() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sources := make([]string, 0, len(s.files))
+	for source := range s.files {
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+func (s *JSONStore) RenameSource(from, to string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, ok := s.files[from]
+	if !ok || from == to || len(s.files[to]) > 0 {
+		return false, nil
+	}
+	s.files[to] = files
+	delete(s.files, from)
+	s.dirty = true
+	return true, nil
+}
+
+func (s *JSONStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	b, err := json.Marshal(s.files)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, b); err != nil {
+		return fmt.Errorf("saving %s: %v", s.path, err)
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *JSONStore) Close() error {
+	return s.Flush()
+}
+
+// writeFileAtomic writes the data to a temporary file in the same directory and renames it to the given path
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,152 @@
+/*
+Package state persists the state of the files tracked by the connector: for each source (an FTP server, or the
+files pushed to it) the info of every file found (see model.FileInfo).
+Two backends are available: an embedded transactional database (bbolt, the default) and the legacy JSON file.
+*/
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ftp-client/model"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// backends of the state store
+const (
+	BackendBolt = "bolt" // embedded transactional database (default)
+	BackendJSON = "json" // single JSON file, rewritten on Flush
+)
+
+// default files of the state backends, inside the state directory
+const (
+	DefaultBoltFile = "state.db"
+	DefaultJSONFile = "log.json"
+)
+
+// ErrNotTracked can be returned by the function passed to Update to leave a file that is not tracked untouched
+var ErrNotTracked = errors.New("file not tracked")
+
+// suffix added to log.json once it has been imported in the database
+const importedSuffix = ".imported"
+
+/*
+Store is the state of the tracked files. The implementations are safe for concurrent use by the goroutines of the servers.
+*/
+type Store interface {
+	// Get returns the info of the file tracked for the source (ok is false if the file is not tracked)
+	Get(source, name string) (info model.FileInfo, ok bool, err error)
+	// Put saves the info of the file
+	Put(source, name string, info model.FileInfo) error
+	/*
+		Update reads, modifies and saves the info of the file in a single transaction. The function receives the current
+		info (the zero value and ok false if the file is not tracked): if it returns an error nothing is saved
+	*/
+	Update(source, name string, fn func(info *model.FileInfo, ok bool) error) error
+	// Files returns all the files tracked for the source (key: filename)
+	Files(source string) (map[string]model.FileInfo, error)
+	// Sources returns the sources with at least a tracked file
+	Sources() ([]string, error)
+	// RenameSource moves the files of a source to a new one, if the new one has no files. It reports whether they were moved
+	RenameSource(from, to string) (bool, error)
+	// Flush persists the pending changes (the database backend writes them on each update, so it's a no-op)
+	Flush() error
+	// Close flushes the pending changes and releases the store
+	Close() error
+}
+
+/*
+Open opens the state store configured. The files of the store are created in dir, unless an explicit path is set.
+When the database backend is used and it's still empty, an existing log.json in dir is imported automatically
+(and then renamed to log.json.imported, so that it's not imported again).
+*/
+func Open(conf model.State, dir string) (Store, error) {
+	switch conf.Backend {
+	case BackendJSON:
+		path := conf.Path
+		if path == "" {
+			path = filepath.Join(dir, DefaultJSONFile)
+		}
+		return OpenJSON(path)
+	case "", BackendBolt:
+		path := conf.Path
+		if path == "" {
+			path = filepath.Join(dir, DefaultBoltFile)
+		}
+		store, err := OpenBolt(path, false)
+		if err != nil {
+			return nil, err
+		}
+		if err := importJSON(store, filepath.Join(dir, DefaultJSONFile)); err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown state backend %q", conf.Backend)
+}
+
+/*
+OpenReadOnly opens the state store configured without modifying it (used by the commands that only show the state).
+While the connector is running it holds the lock of the database: a snapshot of it is read instead (see OpenSnapshot).
+*/
+func OpenReadOnly(conf model.State, dir string) (Store, error) {
+	switch conf.Backend {
+	case BackendJSON:
+		return Open(conf, dir)
+	case "", BackendBolt:
+		path := conf.Path
+		if path == "" {
+			path = filepath.Join(dir, DefaultBoltFile)
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			// the connector was never started with the database: the state may still be in log.json
+			return OpenJSON(filepath.Join(dir, DefaultJSONFile))
+		}
+		store, err := OpenBolt(path, true)
+		if errors.Is(err, errLocked) {
+			return OpenSnapshot(path)
+		}
+		return store, err
+	}
+	return nil, fmt.Errorf("unknown state backend %q", conf.Backend)
+}
+
+// importJSON copies the content of the given log.json in the database, if the database is empty
+func importJSON(store *BoltStore, path string) error {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", path, err)
+	}
+	sources, err := store.Sources()
+	if err != nil {
+		return err
+	}
+	if len(sources) > 0 {
+		slog.Warn("State database not empty, file not imported", "path", path)
+		return nil
+	}
+
+	files := make(map[string]map[string]model.FileInfo)
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &files); err != nil {
+			return fmt.Errorf("decoding %s: %v", path, err)
+		}
+	}
+	// all the files are imported in a single transaction: if the import fails, the database stays empty
+	n, err := store.putAll(files)
+	if err != nil {
+		return fmt.Errorf("importing %s: %v", path, err)
+	}
+	if err := os.Rename(path, path+importedSuffix); err != nil {
+		return err
+	}
+	slog.Info("Files imported into the state database", "files", n, "path", path)
+	return nil
+}
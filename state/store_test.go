@@ -0,0 +1,66 @@
+package state
+
+import (
+	"ftp-client/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportJSON(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, DefaultJSONFile)
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(legacy, []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a corrupted file is not imported: the database stays empty and the file is kept
+	write(`{"line3": {"a.csv": {"timestamp": 1700000000}`)
+	if store, err := Open(model.State{}, dir); err == nil {
+		store.Close()
+		t.Fatal("Open: the corrupted log.json was imported")
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		t.Fatalf("log.json: %v", err)
+	}
+
+	write(`{"line3": {"a.csv": {"timestamp": 1700000000}, "b.csv": {"timestamp": 1700000100}}, "10.0.0.2": {"c.csv": {"timestamp": 1700000200}}}`)
+	store, err := Open(model.State{}, dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, ok := store.(*BoltStore); !ok {
+		t.Fatalf("store %T, want the database", store)
+	}
+	files, err := store.Files("line3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files["a.csv"].Timestamp != 1700000000 || files["b.csv"].Timestamp != 1700000100 {
+		t.Errorf("files of line3 %v, want a.csv and b.csv with their timestamps", files)
+	}
+	if info, ok, _ := store.Get("10.0.0.2", "c.csv"); !ok || info.Timestamp != 1700000200 {
+		t.Errorf("c.csv of 10.0.0.2: %v (tracked: %v)", info, ok)
+	}
+	if _, err := os.Stat(legacy + importedSuffix); err != nil {
+		t.Errorf("log.json not renamed: %v", err)
+	}
+	store.Close()
+
+	// a log.json found later is not imported in a database that isn't empty
+	write(`{"line4": {"d.csv": {"timestamp": 1700000300}}}`)
+	store, err = Open(model.State{}, dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer store.Close()
+	if sources, _ := store.Sources(); len(sources) != 2 {
+		t.Errorf("sources %v, want the ones imported the first time", sources)
+	}
+	if _, err := os.Stat(legacy); err != nil {
+		t.Errorf("the log.json not imported was moved: %v", err)
+	}
+}
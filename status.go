@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"ftp-client/model"
+	"ftp-client/state"
+	"ftp-client/utils"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// serverStatus is the state of the files tracked for a server
+type serverStatus struct {
+	ID           string    `json:"id"`
+	ServerName   string    `json:"server_name,omitempty"`
+	Address      string    `json:"address,omitempty"`
+	Configured   bool      `json:"configured"`              // false if only the state of the server is left
+	Tracked      int       `json:"tracked"`                 // files on the server (the deleted ones excluded)
+	Delivered    int       `json:"delivered"`               // files whose latest version was delivered
+	Pending      int       `json:"pending"`                 // files whose latest version wasn't delivered yet
+	Deleted      int       `json:"deleted"`                 // files deleted from the server (mirror mode)
+	Pushed       int       `json:"pushed"`                  // files pushed to the server
+	LastDetected time.Time `json:"last_detected,omitempty"` // when the latest version of a file was found
+}
+
+/*
+statusCommand prints the state of the files tracked for each server of the configuration (and for the servers
+removed from it whose state is still saved). The state is read only: while the connector is running, a snapshot
+of the database is read.
+Usage: status [-json]
+It returns the exit code of the command.
+*/
+func statusCommand(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the status as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: status [-json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	config, err := utils.LoadConfiguration(configFile)
+	if err != nil {
+		fmt.Printf("Invalid configuration:\n%s\n", err)
+		return 1
+	}
+	store, err := state.OpenReadOnly(config.State, utils.StateDirectory())
+	if err != nil {
+		fmt.Println("Error opening the state: ", err)
+		return 1
+	}
+	defer store.Close()
+
+	var statuses []serverStatus
+	listed := make(map[string]bool)
+	for _, s := range config.Servers {
+		id := utils.SourceID(s)
+		listed[id] = true
+		statuses = append(statuses, serverStatus{ID: id, ServerName: s.ServerName, Address: fmt.Sprintf("%s:%d", s.Host, utils.FTPPort(s)), Configured: true})
+	}
+	sources, err := store.Sources()
+	if err != nil {
+		fmt.Println("Error reading the state: ", err)
+		return 1
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		// the files pushed to a server are tracked in a source of their own (see utils.PushStateKey)
+		id := strings.TrimSuffix(source, utils.PushStateKey(""))
+		if !listed[id] {
+			listed[id] = true
+			statuses = append(statuses, serverStatus{ID: id})
+		}
+	}
+	for i := range statuses {
+		st := &statuses[i]
+		files, err := store.Files(st.ID)
+		if err == nil {
+			var pushed map[string]model.FileInfo
+			pushed, err = store.Files(utils.PushStateKey(st.ID))
+			st.Pushed = len(pushed)
+		}
+		if err != nil {
+			fmt.Println("Error reading the state: ", err)
+			return 1
+		}
+		countFiles(st, files)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(statuses)
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSERVER NAME\tADDRESS\tTRACKED\tDELIVERED\tPENDING\tDELETED\tPUSHED\tLAST DETECTED")
+	for _, st := range statuses {
+		address, last := st.Address, "-"
+		if !st.Configured {
+			address = "(not configured)"
+		}
+		if !st.LastDetected.IsZero() {
+			last = st.LastDetected.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n", st.ID, st.ServerName, address, st.Tracked, st.Delivered, st.Pending, st.Deleted, st.Pushed, last)
+	}
+	w.Flush()
+	return 0
+}
+
+// countFiles fills the counters of the status with the state of the files
+func countFiles(st *serverStatus, files map[string]model.FileInfo) {
+	for _, info := range files {
+		if info.Deleted != 0 {
+			st.Deleted++
+			continue
+		}
+		st.Tracked++
+		if info.Delivered >= info.Timestamp {
+			st.Delivered++
+		} else {
+			st.Pending++
+		}
+		if n := len(info.Versions); n > 0 && info.Versions[n-1].DetectedAt.After(st.LastDetected) {
+			st.LastDetected = info.Versions[n-1].DetectedAt
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"ftp-client/alerts"
+	"ftp-client/metrics"
+	"ftp-client/model"
+	"ftp-client/state"
+	"ftp-client/utils"
+	"ftp-client/webhooks"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// interval between the checks of the configuration file
+const configCheckInterval = 5 * time.Second
+
+/*
+supervisor runs the goroutine of each server (see watchServer) and applies the configuration reloaded:
+the goroutines of the new servers are started, the ones of the servers removed are stopped and the ones of
+the servers whose settings changed are restarted. The others keep running undisturbed.
+*/
+type supervisor struct {
+	file        string // configuration file
+	store       state.Store
+	fileChannel chan utils.FileToUpload
+	cloud       *utils.CloudSettings
+	webhooks    *webhooks.Dispatcher
+	alerts      *alerts.Notifier
+	logger      *slog.Logger
+	hash        [sha256.Size]byte // hash of the configuration file last loaded (even if invalid)
+	heartbeat   atomic.Int64      // last iteration of the configuration loop (unix ns), see handleHealthz
+	bucket      bucketCheck
+	transfers   transferLog // latest transfers, shown by the dashboard
+
+	mu       sync.Mutex          // held by apply, so that the configurations are applied one at a time
+	started  bool                // the first configuration was applied
+	stopped  bool                // the goroutines were stopped (see stop): no configuration is applied anymore
+	config   model.Config        // configuration applied
+	watchers map[string]*watcher // key: source ID of the server
+
+	// the HTTP handlers read a snapshot of the configuration and of the goroutines (see view), so that they're
+	// never blocked by a configuration being applied
+	viewMu sync.RWMutex
+	view   supervisorView
+
+	controlsMu sync.Mutex
+	controls   map[string]*serverControl // key: source ID of the server (see control)
+}
+
+// supervisorView is the configuration applied and the goroutines of its servers, as read by the HTTP handlers
+type supervisorView struct {
+	config   model.Config
+	watchers map[string]*watcher
+}
+
+// watcher is the goroutine of a server
+type watcher struct {
+	settings watcherSettings
+	cancel   context.CancelFunc
+	done     chan struct{} // closed when the goroutine returns
+	stopping atomic.Bool   // the goroutine was stopped by the supervisor (to be restarted or removed)
+	health   *serverHealth
+}
+
+// watcherSettings are the settings used by the goroutine of a server: if they change, the goroutine is restarted
+type watcherSettings struct {
+	Server       model.Server
+	Compression  *model.Compression
+	Encryption   *model.Encryption
+	HistoryLimit int
+}
+
+func newSupervisor(file string, store state.Store, fileChannel chan utils.FileToUpload, cloud *utils.CloudSettings,
+	hooks *webhooks.Dispatcher, notifier *alerts.Notifier, logger *slog.Logger) *supervisor {
+	s := &supervisor{file: file, store: store, fileChannel: fileChannel, cloud: cloud, webhooks: hooks, alerts: notifier, logger: logger, watchers: make(map[string]*watcher), controls: make(map[string]*serverControl)}
+	s.heartbeat.Store(time.Now().UnixNano())
+	if b, err := os.ReadFile(file); err == nil {
+		s.hash = sha256.Sum256(b)
+	}
+	return s
+}
+
+func settingsOf(conf model.Server, config model.Config) watcherSettings {
+	return watcherSettings{
+		Server:       conf,
+		Compression:  utils.EffectiveCompression(conf, config.CloudStorage),
+		Encryption:   utils.EffectiveEncryption(conf, config),
+		HistoryLimit: config.State.HistoryLimit,
+	}
+}
+
+/*
+apply applies the configuration (already validated): the first time all the goroutines are started,
+then only the differences with the configuration applied before are.
+*/
+func (s *supervisor) apply(config model.Config) {
+	s.mu.Lock()
+	old, first, halted := s.config, !s.started, s.stopped
+	s.mu.Unlock()
+	if halted {
+		return
+	}
+	// the client of the new Cloud Storage settings is created without the lock, since it retries the connection for a while
+	cloudChanged := !first && !reflect.DeepEqual(old.CloudStorage, config.CloudStorage)
+	var cloudClient *utils.ClientCloudStorage
+	if cloudChanged {
+		cloudClient = s.newCloudClient(config.CloudStorage)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return // stopped while the client was created
+	}
+	if !first {
+		if !reflect.DeepEqual(old.Log, config.Log) {
+			utils.ApplyLogConfig(config.Log)
+			s.logger.Info("Log settings applied", "level", config.Log.Level, "format", config.Log.Format)
+		}
+		if cloudChanged {
+			// the old client is not closed: the uploads in progress are still using it
+			s.cloud.Set(cloudClient, config.CloudStorage)
+			s.logger.Info("Cloud Storage settings applied", "config", config.CloudStorage)
+		}
+		if !reflect.DeepEqual(old.State, config.State) && (old.State.Backend != config.State.Backend || old.State.Path != config.State.Path) {
+			s.logger.Warn("The state backend can't be changed while running: restart the connector to apply it")
+		}
+		// the events already queued are still delivered to the old webhooks
+		s.webhooks.Apply(config.Webhooks)
+		s.alerts.Apply(config)
+		if old.HTTP.Listen != config.HTTP.Listen {
+			s.logger.Warn("The HTTP settings can't be changed while running: restart the connector to apply them")
+		}
+	}
+
+	// the uploader saves the files locally with the settings of the servers in use
+	s.cloud.SetConfig(config)
+
+	// the state saved by server_name is moved to the ID of the new servers as well
+	if err := utils.MigrateStateKeys(s.store, config.Servers); err != nil {
+		s.logger.Error("Error migrating the state", "error", err)
+	}
+
+	servers := make(map[string]model.Server, len(config.Servers))
+	for _, conf := range config.Servers {
+		servers[utils.SourceID(conf)] = conf
+	}
+	// stop the goroutines of the servers removed or changed (all together, then wait for them)
+	var stopped []*watcher
+	var restart, removed []string
+	for id, w := range s.watchers {
+		conf, ok := servers[id]
+		if ok && reflect.DeepEqual(w.settings, settingsOf(conf, config)) {
+			continue
+		}
+		if ok {
+			s.logger.Info("Server changed: restarting its goroutine", "server", id)
+			restart = append(restart, id)
+		} else {
+			s.logger.Info("Server removed: stopping its goroutine", "server", id)
+			utils.CloseLogWriter(id)
+			removed = append(removed, id)
+		}
+		w.stopping.Store(true)
+		w.cancel()
+		stopped = append(stopped, w)
+		delete(s.watchers, id)
+	}
+	for _, w := range stopped {
+		<-w.done
+	}
+	for _, id := range removed {
+		metrics.RemoveServer(id)
+		s.controlsMu.Lock()
+		delete(s.controls, id)
+		s.controlsMu.Unlock()
+	}
+	for _, id := range restart {
+		s.start(servers[id], config)
+	}
+	// start the goroutines of the new servers
+	for _, conf := range config.Servers {
+		if _, ok := s.watchers[utils.SourceID(conf)]; !ok {
+			if !first {
+				s.logger.Info("Server added: starting its goroutine", "server", utils.SourceID(conf))
+			}
+			s.start(conf, config)
+		}
+	}
+	s.config = config
+	s.started = true
+	s.publish()
+}
+
+/*
+stop stops the goroutines of all the servers and waits for them to return (the cycles in progress are completed),
+e.g. before the process exits. The configurations reloaded afterwards are not applied.
+*/
+func (s *supervisor) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for _, w := range s.watchers {
+		w.stopping.Store(true)
+		w.cancel()
+	}
+	for id, w := range s.watchers {
+		<-w.done
+		delete(s.watchers, id)
+	}
+	s.publish()
+}
+
+// publish replaces the snapshot read by the HTTP handlers with the configuration and the goroutines in use
+func (s *supervisor) publish() {
+	watchers := make(map[string]*watcher, len(s.watchers))
+	for id, w := range s.watchers {
+		watchers[id] = w
+	}
+	s.viewMu.Lock()
+	s.view = supervisorView{config: s.config, watchers: watchers}
+	s.viewMu.Unlock()
+}
+
+// snapshot returns the configuration applied and the goroutines of its servers (they must not be modified)
+func (s *supervisor) snapshot() supervisorView {
+	s.viewMu.RLock()
+	defer s.viewMu.RUnlock()
+	return s.view
+}
+
+// start starts the goroutine of the server
+func (s *supervisor) start(conf model.Server, config model.Config) {
+	id := utils.SourceID(conf)
+	logger := utils.ServerLogger(config, conf)
+	// create the folder to which this client will store the files downloaded (final local path is: <data dir>/<source-ID>/)
+	utils.CheckDirectory(utils.LocalDir(id))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &watcher{settings: settingsOf(conf, config), cancel: cancel, done: make(chan struct{}), health: newServerHealth()}
+	s.watchers[id] = w
+	control := s.control(id)
+	go func() {
+		defer close(w.done)
+		watchServer(ctx, conf, config, logger, s.store, s.fileChannel, s.cloud, w.health, control, nil)
+	}()
+}
+
+// newCloudClient creates the client of the new Cloud Storage configuration (nil if it can't be created)
+func (s *supervisor) newCloudClient(cs model.CloudStorage) *utils.ClientCloudStorage {
+	client, err := utils.NewClientCloudStorage(cs, s.logger)
+	if err != nil {
+		// the files are saved locally until a valid configuration is loaded
+		s.logger.Error("Error creating the Cloud Storage client of the new configuration", "error", err)
+	}
+	return client
+}
+
+/*
+reload loads the configuration file and applies it. An invalid configuration is rejected:
+the problems are logged and the configuration in use is kept.
+*/
+func (s *supervisor) reload() {
+	config, err := utils.LoadConfiguration(s.file)
+	if err != nil {
+		s.logger.Error("Invalid configuration, not applied", "error", err)
+		return
+	}
+	s.logger.Info("Configuration reloaded")
+	s.apply(config)
+}
+
+/*
+watchConfig reloads the configuration when the file changes (its content is checked every few seconds)
+or when the process receives SIGHUP, until the context is canceled.
+The configurations are applied by another goroutine, so that a slow reload (e.g. waiting for the cycles in
+progress) doesn't stop the heartbeat of the loop: a reload requested meanwhile is applied once it's done.
+*/
+func (s *supervisor) watchConfig(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	reloads := make(chan struct{}, 1)
+	defer close(reloads)
+	go func() {
+		for range reloads {
+			s.reload()
+		}
+	}()
+	requestReload := func() {
+		select {
+		case reloads <- struct{}{}:
+		default: // a reload is already pending: it reads the file again
+		}
+	}
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+	for {
+		s.heartbeat.Store(time.Now().UnixNano())
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			s.logger.Info("SIGHUP received: reloading the configuration")
+			s.updateHash()
+			requestReload()
+		case <-ticker.C:
+			if s.updateHash() {
+				s.logger.Info("Configuration file changed: reloading it")
+				requestReload()
+			}
+		}
+	}
+}
+
+// updateHash saves the hash of the configuration file and reports whether it changed
+func (s *supervisor) updateHash() bool {
+	b, err := os.ReadFile(s.file)
+	if err != nil {
+		return false // e.g. the file is being replaced: it's checked again later
+	}
+	hash := sha256.Sum256(b)
+	if hash == s.hash {
+		return false
+	}
+	s.hash = hash
+	return true
+}
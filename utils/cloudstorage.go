@@ -0,0 +1,515 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"ftp-client/events"
+	"ftp-client/metrics"
+	"ftp-client/model"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+/* CLOUD STORAGE OBJECTS */
+// client uploader to cloud storage
+type ClientCloudStorage struct {
+	Client     *storage.Client
+	ProjectID  string
+	BucketName string
+	UploadPath string
+	CreateOnly bool // if true, existing objects are never overwritten (see UploadFile)
+
+	ChunkSize     int           // size [bytes] of the chunks of a resumable upload
+	Timeout       time.Duration // base timeout of an upload attempt
+	MinThroughput int           // min expected throughput [bytes/s] used to scale the timeout with the file size
+
+	HTTPClient *http.Client              // authenticated client used for the resumable upload sessions
+	sessions   map[string]*uploadSession // resumable sessions not completed yet (key: object path)
+	mu         sync.Mutex                // protects sessions
+}
+
+const (
+	defaultChunkSize     = 8 * 1024 * 1024  // 8 MiB
+	defaultUploadTimeout = 50 * time.Second // timeout of an upload attempt if "upload_timeout" is not set
+)
+
+// ErrObjectConflict is returned by UploadFile (in "create only" mode) when the object already exists
+// in the bucket with a content different from the one that is being uploaded
+var ErrObjectConflict = errors.New("object already exists with a different content")
+
+// the structure of the file that will be uploaded
+type FileToUpload struct {
+	Data         []byte // bytes read from file downloaded from FTP server
+	Filename     string // cloud storage object's name
+	OriginalName string // filename as the original retrieved from FTP server
+	Host         string // host IP (used to save the object at the Host folder created in the bucket)
+	ServerName   string // the "resolved" name of the Host
+	SourceID     string // the ID of the FTP server (see SourceID)
+
+	ContentEncoding string            // Content-Encoding of the object (e.g. "gzip" if the data is compressed with gzip)
+	Metadata        map[string]string // custom metadata stored with the object
+
+	Timestamp uint64 // timestamp of the file's version on the FTP server
+	// (optional) called once the file is delivered to the destination (err == nil) or its delivery failed
+	Done func(destination string, err error)
+}
+
+// delivered calls the Done callback of the file (if set) with the outcome of its delivery
+func (f FileToUpload) delivered(destination string, err error) {
+	if f.Done != nil {
+		f.Done(destination, err)
+	}
+}
+
+/*
+NewClientCloudStorage will initialize a new ClientCloudStorage object with the given parameters
+The return values are the Cloud Storage client and the error.
+At most N=cs.ConnectionAttempts attempts of client initialization will be performed.
+If all the attempts fail, it returns (nil,error). Otherwise it returns (client, nil)
+If error != nil is returned, the FTP files will be stored locally and not uploaded to the cloud.
+*/
+func NewClientCloudStorage(cs model.CloudStorage, logger *slog.Logger) (*ClientCloudStorage, error) {
+	return NewClientCloudStorageContext(context.Background(), cs, logger)
+}
+
+/*
+NewClientCloudStorageContext is like NewClientCloudStorage, but it stops retrying (returning the context's error)
+when the context is canceled, e.g. because the request of the admin API that asked for the client timed out.
+The context is not used by the client created.
+*/
+func NewClientCloudStorageContext(ctx context.Context, cs model.CloudStorage, logger *slog.Logger) (*ClientCloudStorage, error) {
+	// the credentials may be a reference to a secret (env: or file:)
+	credentials, err := CloudCredentials(cs)
+	if err != nil {
+		return nil, fmt.Errorf("reading the Cloud Storage credentials: %v", err)
+	}
+	i := 0
+	for {
+		client, err := storage.NewClient(context.Background(), credentials)
+		if err == nil {
+			// the resumable upload sessions are managed directly with the JSON API (see resumable.go)
+			var httpClient *http.Client
+			httpClient, _, err = htransport.NewClient(context.Background(), credentials, option.WithScopes(storage.ScopeReadWrite))
+			if err == nil {
+				logger.Debug("Cloud Storage client created", "bucket", cs.BucketName, "attempt", i+1)
+				return &ClientCloudStorage{
+					Client:        client,
+					ProjectID:     cs.ProjectID,
+					BucketName:    cs.BucketName,
+					UploadPath:    cs.UploadPath,
+					CreateOnly:    cs.CreateOnly,
+					ChunkSize:     cs.ChunkSize * 1024,
+					Timeout:       time.Duration(cs.UploadTimeout) * time.Millisecond,
+					MinThroughput: cs.MinThroughput * 1024,
+					HTTPClient:    httpClient,
+					sessions:      make(map[string]*uploadSession),
+				}, nil
+			}
+			client.Close()
+		}
+
+		if err != nil {
+			logger.Warn("Error creating the Cloud Storage client", "attempt", i+1, "error", err)
+			if i == cs.ConnectionAttempts {
+				logger.Error("Max retry connection attempts: all attempts failed creating the Cloud Storage client")
+				err = errors.New("all attempts failed creating Cloud Storage client")
+				return nil, err
+			}
+		}
+		i++
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(cs.RetryConnection) * time.Millisecond):
+		}
+	}
+}
+
+/*
+UploadFile will upload the given file (passed as parameter) to the cloud storage
+object with the same name as the file.
+
+Files bigger than one chunk are uploaded with a resumable upload session (see resumableUpload): if an attempt
+fails, the next one continues from the last committed chunk. The timeout of each attempt is computed from the
+file size (see uploadTimeout).
+
+If the client is in "create only" mode, the object is written with a DoesNotExist precondition so that
+an object already present in the bucket is never overwritten. When the precondition fails, the existing
+object is compared with the file: if the content hash is the same the upload is considered successful
+(e.g. the file was already uploaded before a restart), otherwise ErrObjectConflict is returned.
+*/
+func (c *ClientCloudStorage) UploadFile(file FileToUpload) error {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, c.uploadTimeout(len(file.Data)))
+	defer cancel()
+
+	// Upload the file to a cloud storage object https://adityarama1210.medium.com/simple-golang-api-uploader-using-google-cloud-storage-3d5e45df74a5
+	filePath := c.ObjectPath(file)
+	if len(file.Data) > c.chunkSize() {
+		err := c.resumableUpload(ctx, filePath, file)
+		if c.CreateOnly && isPreconditionFailed(err) {
+			return c.checkExistingObject(ctx, filePath, file.Data)
+		}
+		return err
+	}
+
+	obj := c.Client.Bucket(c.BucketName).Object(filePath)
+	if c.CreateOnly {
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	}
+	sum := md5.Sum(file.Data)
+	wc := obj.NewWriter(ctx)
+	wc.ChunkSize = 0 // the file fits in a single chunk: upload it with a single request
+	wc.MD5 = sum[:]  // the object is rejected by Cloud Storage if the data received doesn't match the hash
+	wc.ContentEncoding = file.ContentEncoding
+	wc.Metadata = file.Metadata
+	if _, err := wc.Write(file.Data); err != nil {
+		return fmt.Errorf("io.Copy: %v", err)
+	}
+	if err := wc.Close(); err != nil {
+		if c.CreateOnly && isPreconditionFailed(err) {
+			return c.checkExistingObject(ctx, filePath, file.Data)
+		}
+		return fmt.Errorf("Writer.Close: %v", err)
+	}
+	return nil
+}
+
+// ObjectPath returns the path of the file's object in the bucket
+func (c *ClientCloudStorage) ObjectPath(file FileToUpload) string {
+	return fmt.Sprintf("%s/%s/%s", c.UploadPath, file.SourceID, file.Filename) // example path in bucket: FTP/<source-ID>/<filename.ext>
+}
+
+// ObjectURL returns the URL (gs://<bucket>/<path>) of the file's object
+func (c *ClientCloudStorage) ObjectURL(file FileToUpload) string {
+	return fmt.Sprintf("gs://%s/%s", c.BucketName, c.ObjectPath(file))
+}
+
+// SplitObjectURL returns the bucket and the path of the object of a URL returned by ObjectURL (ok is false for a local path)
+func SplitObjectURL(url string) (bucket, object string, ok bool) {
+	rest, ok := strings.CutPrefix(url, "gs://")
+	if !ok {
+		return "", "", false
+	}
+	bucket, object, _ = strings.Cut(rest, "/")
+	return bucket, object, true
+}
+
+/*
+uploadTimeout returns the timeout of an upload attempt for a file of the given size:
+the base timeout plus the time needed to transfer the file at the min expected throughput.
+*/
+func (c *ClientCloudStorage) uploadTimeout(size int) time.Duration {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultUploadTimeout
+	}
+	if c.MinThroughput > 0 {
+		timeout += time.Duration(float64(size) / float64(c.MinThroughput) * float64(time.Second))
+	}
+	return timeout
+}
+
+/*
+checkExistingObject compares the object already stored at the given path with the data that was going to be uploaded.
+It returns nil if both have the same hash, ErrObjectConflict otherwise.
+*/
+func (c *ClientCloudStorage) checkExistingObject(ctx context.Context, filePath string, data []byte) error {
+	attrs, err := c.Client.Bucket(c.BucketName).Object(filePath).Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("Object.Attrs: %v", err)
+	}
+	// composite objects don't have an MD5 hash: in that case fall back to the CRC32C checksum
+	if len(attrs.MD5) > 0 {
+		sum := md5.Sum(data)
+		if bytes.Equal(attrs.MD5, sum[:]) {
+			return nil
+		}
+	} else if attrs.CRC32C == crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)) {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", filePath, ErrObjectConflict)
+}
+
+/*
+CheckBucket checks that the bucket can be reached with the credentials of the client. A bucket whose metadata can't be
+read (HTTP 403, e.g. a service account that can only create objects) is considered reachable.
+*/
+func (c *ClientCloudStorage) CheckBucket(ctx context.Context) error {
+	_, err := c.Client.Bucket(c.BucketName).Attrs(ctx)
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) && gErr.Code == http.StatusForbidden {
+		return nil
+	}
+	return err
+}
+
+// isPreconditionFailed checks whether the error returned by Cloud Storage is caused by a failed precondition (HTTP 412)
+func isPreconditionFailed(err error) bool {
+	var gErr *googleapi.Error
+	var pErr *preconditionFailedError
+	return (errors.As(err, &gErr) && gErr.Code == http.StatusPreconditionFailed) || errors.As(err, &pErr)
+}
+
+/*
+CloudSettings holds the Cloud Storage client and configuration in use, and whether the files are uploaded to Cloud Storage
+or saved locally (the upload is disabled when the client can't be created or the max upload attempts are reached).
+They're replaced when the configuration is reloaded, while the goroutines are using them, so the access is protected by a mutex.
+*/
+type CloudSettings struct {
+	mu     sync.RWMutex
+	client *ClientCloudStorage
+	conf   model.CloudStorage
+	upload bool
+	config model.Config // whole configuration in use (the servers' settings are needed to save the files locally)
+}
+
+/*
+NewCloudSettings returns the settings with the given client (nil if it couldn't be created). If a bucket is configured
+but the client is not valid, the upload_disabled event is emitted.
+*/
+func NewCloudSettings(client *ClientCloudStorage, conf model.CloudStorage) *CloudSettings {
+	c := &CloudSettings{upload: conf.BucketName != ""}
+	c.Set(client, conf)
+	return c
+}
+
+/*
+Set replaces the client and the configuration: the upload is enabled again if the client is valid.
+The change of the upload flag (if any) is emitted as an event.
+*/
+func (c *CloudSettings) Set(client *ClientCloudStorage, conf model.CloudStorage) {
+	c.mu.Lock()
+	was := c.upload
+	c.client, c.conf, c.upload = client, conf, client != nil
+	c.mu.Unlock()
+	uploadChanged(was, client != nil, conf.BucketName, errors.New("the Cloud Storage client could not be created"))
+}
+
+// Get returns the client (nil if not available) and the configuration in use
+func (c *CloudSettings) Get() (*ClientCloudStorage, model.CloudStorage) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.client, c.conf
+}
+
+// SetConfig replaces the configuration in use (see Config)
+func (c *CloudSettings) SetConfig(config model.Config) {
+	c.mu.Lock()
+	c.config = config
+	c.mu.Unlock()
+}
+
+// Config returns the whole configuration in use
+func (c *CloudSettings) Config() model.Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.config
+}
+
+// Client returns the client in use (nil if not available)
+func (c *CloudSettings) Client() *ClientCloudStorage {
+	client, _ := c.Get()
+	return client
+}
+
+// UploadEnabled reports whether the files must be sent to the uploader (otherwise they're saved locally)
+func (c *CloudSettings) UploadEnabled() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.upload
+}
+
+// EnableUpload tells the goroutines to send the files to the uploader again. It fails if there's no valid client
+func (c *CloudSettings) EnableUpload() bool {
+	c.mu.Lock()
+	was := c.upload
+	c.upload = c.client != nil
+	upload, bucket := c.upload, c.conf.BucketName
+	c.mu.Unlock()
+	uploadChanged(was, upload, bucket, nil)
+	return upload
+}
+
+// DisableUpload tells the goroutines to save the files locally, because of the given error
+func (c *CloudSettings) DisableUpload(reason error) {
+	c.mu.Lock()
+	was := c.upload
+	c.upload = false
+	bucket := c.conf.BucketName
+	c.mu.Unlock()
+	uploadChanged(was, false, bucket, reason)
+}
+
+// uploadChanged emits the event of the change of the upload flag (if it changed), with the reason of the disabling
+func uploadChanged(was, upload bool, bucket string, reason error) {
+	if was == upload {
+		return
+	}
+	event := events.Event{Type: events.UploadEnabled, Bucket: bucket}
+	if !upload {
+		event.Type = events.UploadDisabled
+		if reason != nil {
+			event.Error = reason.Error()
+		}
+	}
+	events.Emit(event)
+}
+
+/*
+CloudStorageUpload will read from the given channel, until it's closed, and extract the file that needs to
+uploaded to the Cloud Storage bucket. The first time an upload, for a given file, fails N times in a row
+(where N is set as "file_upload_attempts"), from now on all the files will be stored locally
+and not uploaded to cloud (until the Cloud Storage configuration is reloaded).
+
+Those files there were already in the channel (sent from the other FTP client) will not be uploaded
+but indeed stored locally, as the ones sent to the channel afterwards: the delivery of every file sent is confirmed
+(see FileToUpload.Done), so that the failed ones are transferred again.
+The upload flag of the settings is used to inform the other gorotuines whether to send file to the channel (to be later uploaded)
+or to store it locally. The client and the configuration are read from the settings for each file, so the ones reloaded are used.
+
+This function accepts a logger as a parameter that is used to log the info about the upload of a file.
+The wait group is done when the channel is closed and every file read from it was delivered (or saved locally).
+*/
+func CloudStorageUpload(ch <-chan FileToUpload, wg *sync.WaitGroup, cloud *CloudSettings, logger *slog.Logger) {
+	defer wg.Done()
+	logger.Debug("Upload goroutine started")
+	// get the files, until the channel is closed (when the connector is stopped)
+	for obj := range ch {
+		client, cs := cloud.Get()
+		if client == nil || !cloud.UploadEnabled() {
+			// the files sent to the channel after the upload was disabled are saved locally as well
+			filesToSaveLocally := map[string][]FileToUpload{obj.SourceID: {obj}}
+			getAllFilesFromChannel(ch, filesToSaveLocally)
+			wg.Add(1)
+			go saveFilesLocallyFromChannel(wg, filesToSaveLocally, logger)
+			continue
+		}
+		attempts, resumes := 1, 0 // file upload attempts, and the ones that were resumed (see below)
+		log := logger.With("server", obj.SourceID, "host", obj.Host, "file", obj.OriginalName, "object", obj.Filename, "size", len(obj.Data))
+		for {
+			log.Debug("Uploading file", "attempt", attempts)
+			//filename :=  // path is: host/file.ext
+			start := time.Now()
+			err := client.UploadFile(obj)
+			if errors.Is(err, ErrObjectConflict) {
+				// retrying won't help: the object in the bucket must be checked manually.
+				// The conflict doesn't count as an upload failure
+				log.Error("Conflict uploading file", "error", err)
+				uploaded(obj, client.ObjectPath(obj), start, err)
+				obj.delivered(client.ObjectURL(obj), err)
+				break
+			}
+			if err != nil {
+				log.Warn("Error uploading file", "attempt", attempts, "duration", time.Since(start), "error", err)
+				/* a resumable upload that committed some chunks is slow, not failing: the attempt doesn't count,
+				up to the max resumes, so that a very slow link doesn't keep the files of the other servers waiting */
+				var pErr *uploadProgressError
+				if errors.As(err, &pErr) && pErr.Advanced && resumes < cs.MaxResumes {
+					resumes++
+					log.Info("Upload interrupted, resuming", "committed", pErr.Committed, "resume", resumes)
+					time.Sleep(time.Duration(cs.RetryUpload) * time.Millisecond)
+					continue
+				}
+				if attempts >= cs.FileUploadAttempts {
+					// stop uploading and start saving files locally
+					log.Error("Max upload attempts reached: upload to Cloud Storage is disabled", "attempt", attempts, "queued", len(ch))
+					// tells the other goroutines to save files locally
+					cloud.DisableUpload(fmt.Errorf("max upload attempts reached: %v", err))
+					uploaded(obj, client.ObjectPath(obj), start, err)
+
+					/* retrieve all the files in the channel and save them locally */
+					filesToSaveLocally := make(map[string][]FileToUpload)
+					// save the current file and get the others
+					filesToSaveLocally[obj.SourceID] = append(filesToSaveLocally[obj.SourceID], obj)
+					getAllFilesFromChannel(ch, filesToSaveLocally)
+					wg.Add(1)
+					go saveFilesLocallyFromChannel(wg, filesToSaveLocally, logger)
+					break
+				}
+				attempts++
+				time.Sleep(time.Duration(cs.RetryUpload) * time.Millisecond)
+			} else {
+				log.Info("File uploaded successfully", "attempt", attempts, "duration", time.Since(start))
+				metrics.FilesUploaded.WithLabelValues(obj.SourceID).Inc()
+				metrics.Transferred(obj.SourceID, metrics.Upload, int64(len(obj.Data)), time.Since(start))
+				metrics.LastUpload.WithLabelValues(obj.SourceID).SetToCurrentTime()
+				uploaded(obj, client.ObjectPath(obj), start, nil)
+				obj.delivered(client.ObjectURL(obj), nil)
+				break
+			}
+		}
+	}
+}
+
+// uploaded emits the event of the upload of the file (failed if err is not nil)
+func uploaded(file FileToUpload, object string, start time.Time, err error) {
+	event := events.Event{Type: events.FileUploaded, Server: file.SourceID, Host: file.Host, File: file.OriginalName,
+		Object: object, Size: int64(len(file.Data)), Duration: events.Milliseconds(time.Since(start))}
+	if err != nil {
+		event.Type, event.Error = events.UploadFailed, err.Error()
+	}
+	events.Emit(event)
+}
+
+/*
+Get all the files from the channel (that were inserted into it before the upload to Cloud Storage failed) and save them in the map.
+That map will be used later on to retrieve the info of the file that needs to be downloaded.
+*/
+func getAllFilesFromChannel(ch <-chan FileToUpload, m map[string][]FileToUpload) {
+	for len(ch) > 0 {
+		f := <-ch
+		m[f.SourceID] = append(m[f.SourceID], f)
+	}
+}
+
+/*
+saveFilesLocallyFromChannel saves all the files found for each host (saved in the map parameter)
+locally. Those files are the ones that were previously send in the channel and need to be
+manually saved (since this function will execute when the upload to cloud storage is disabled by some errors).
+The data of the files is already in memory (compressed and encrypted like the objects): it's written as it is,
+at <data dir>/<source-ID>/<object's name>.
+*/
+func saveFilesLocallyFromChannel(wg *sync.WaitGroup, m map[string][]FileToUpload, logger *slog.Logger) {
+	defer wg.Done()
+	for source, files := range m {
+		logger.Info("Saving the queued files locally", "server", source, "files", len(files))
+		for _, file := range files {
+			log := logger.With("server", source, "host", file.Host, "file", file.OriginalName)
+			start := time.Now()
+			localPath := filepath.Join(LocalDir(source), file.Filename)
+			if file.ContentEncoding == CompressionGzip {
+				localPath += ".gz" // the object is stored with the gzip Content-Encoding, the local file needs the suffix
+			}
+			err := writeFile(localPath, func(w io.Writer) error {
+				_, err := w.Write(file.Data)
+				return err
+			})
+			event := events.Event{Type: events.FileDownloaded, Server: source, Host: file.Host, File: file.OriginalName,
+				Local: localPath, Duration: events.Milliseconds(time.Since(start))}
+			if err != nil {
+				log.Error("Error saving local file", "error", err)
+				event.Type, event.Error = events.DownloadFailed, err.Error()
+			} else {
+				log.Info("File saved locally", "path", localPath, "duration", time.Since(start))
+				metrics.FilesDownloaded.WithLabelValues(source).Inc()
+			}
+			events.Emit(event)
+			file.delivered(localPath, err)
+		}
+	}
+}
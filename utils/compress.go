@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"ftp-client/model"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// supported compression algorithms
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// metadata stored with the objects compressed before the upload
+const (
+	MetadataOriginalSize   = "original-size"
+	MetadataOriginalSHA256 = "original-sha256"
+	MetadataCompression    = "compression"
+)
+
+/*
+EffectiveCompression returns the compression to apply to the files of the given server:
+the server's own setting if present, otherwise the one of the sink (Cloud Storage).
+It returns nil if the files must not be compressed.
+*/
+func EffectiveCompression(server model.Server, cs model.CloudStorage) *model.Compression {
+	c := cs.Compression
+	if server.Compression != nil {
+		c = server.Compression
+	}
+	if c == nil || c.Algorithm == "" || c.Algorithm == "none" {
+		return nil
+	}
+	return c
+}
+
+// CompressionSuffix returns the suffix added to the name of a file compressed with the given compression
+func CompressionSuffix(c *model.Compression) string {
+	if c == nil {
+		return ""
+	}
+	switch c.Algorithm {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+/*
+NewCompressWriter returns a writer that compresses the data written to it (with the given compression) to w.
+The writer must be closed to flush the data. If c is nil the data is written as it is.
+A level equal to 0 selects the default level of the algorithm.
+*/
+func NewCompressWriter(w io.Writer, c *model.Compression) (io.WriteCloser, error) {
+	if c == nil {
+		return nopWriteCloser{w}, nil
+	}
+	switch c.Algorithm {
+	case CompressionGzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CompressionZstd:
+		level := zstd.SpeedDefault
+		if c.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	}
+	return nil, fmt.Errorf("unknown compression algorithm %q", c.Algorithm)
+}
+
+/*
+CompressFile compresses the data of the file that will be uploaded to Cloud Storage.
+Since Cloud Storage decompresses gzip objects on download (decompressive transcoding), gzip files keep
+their name and are stored with "Content-Encoding: gzip". Files compressed with the other algorithms
+get the algorithm's suffix (e.g. ".zst").
+The original size and SHA-256 hash of the file are stored in the object's metadata.
+*/
+func CompressFile(file *FileToUpload, c *model.Compression) error {
+	if c == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	w, err := NewCompressWriter(&buf, c)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(file.Data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(file.Data)
+	if file.Metadata == nil {
+		file.Metadata = make(map[string]string)
+	}
+	file.Metadata[MetadataOriginalSize] = strconv.Itoa(len(file.Data))
+	file.Metadata[MetadataOriginalSHA256] = hex.EncodeToString(sum[:])
+	file.Metadata[MetadataCompression] = c.Algorithm
+	file.Data = buf.Bytes()
+	if c.Algorithm == CompressionGzip {
+		file.ContentEncoding = "gzip"
+	} else {
+		file.Filename += CompressionSuffix(c)
+	}
+	return nil
+}
+
+/*
+SaveFileLocally writes the data read from the reader to the local file at the given path, compressing it
+with the given compression and then encrypting it with the given encryptor (if not nil).
+The suffixes of the algorithms are added to the path (e.g. "file.csv.gz.enc"). It returns the path of the file written.
+If a step fails, no file is left at the path (see writeFile).
+*/
+func SaveFileLocally(reader io.Reader, path string, c *model.Compression, enc *Encryptor) (string, error) {
+	path += CompressionSuffix(c)
+	if enc != nil {
+		path += EncryptionSuffix
+	}
+	err := writeFile(path, func(outFile io.Writer) error {
+		var err error
+		var w io.WriteCloser = nopWriteCloser{outFile}
+		var ew io.WriteCloser = nopWriteCloser{outFile}
+		if enc != nil {
+			if ew, err = enc.NewEncryptWriter(outFile); err != nil {
+				return err
+			}
+			w = ew
+		}
+		cw, err := NewCompressWriter(w, c)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(cw, reader); err != nil {
+			return err
+		}
+		// close the writers in order: compression and then encryption (the file is closed by writeFile)
+		if err := cw.Close(); err != nil {
+			return err
+		}
+		return ew.Close()
+	})
+	return path, err
+}
+
+/*
+writeFile writes the local file at the given path with the write function. The data is written to a temporary file
+in the same directory, renamed to the path once complete: a failed write never leaves a partial file at the path.
+*/
+func writeFile(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
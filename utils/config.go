@@ -0,0 +1,608 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ftp-client/events"
+	"ftp-client/model"
+	"ftp-client/state"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// default values of the fields omitted in the configuration file
+const (
+	defaultSampling           = 1000  // ms
+	defaultRetryConnection    = 10000 // ms
+	defaultRetryUpload        = 5000  // ms
+	defaultUploadAttempts     = 4
+	defaultConnectionAttempts = 4
+	defaultMaxResumes         = 10
+	defaultLogSize            = 1 // MB
+	defaultLogBackups         = 3
+	defaultLogAge             = 28     // days
+	defaultStaleAfter         = 300000 // ms
+	defaultWebhookTimeout     = 5000   // ms
+	defaultWebhookAttempts    = 5
+	defaultWebhookRetry       = 1000 // ms
+	defaultSMTPPort           = 587
+	defaultSMTPTLSPort        = 465
+	defaultSMTPTimeout        = 10000 // ms
+	defaultMailsPerHour       = 20
+	defaultAlertAfter         = 300000  // ms
+	defaultAlertInterval      = 1800000 // ms
+)
+
+// min value of the intervals of the servers, to avoid busy loops
+const minInterval = 100 // ms
+
+// max value of the attempts counts
+const maxAttempts = 100
+
+// ConfigError is a problem found in the configuration file
+type ConfigError struct {
+	Field  string // path of the field, e.g. servers[0].sampling (empty if the problem is not about a field)
+	Line   int    // position of the field in the file (0 if unknown)
+	Column int
+	Msg    string
+}
+
+func (e ConfigError) Error() string {
+	var b strings.Builder
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "line %d, column %d: ", e.Line, e.Column)
+	}
+	if e.Field != "" {
+		b.WriteString(e.Field + ": ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+// ConfigErrors is the list of the problems found in the configuration file
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// add appends the errors whose field doesn't have an error yet (e.g. a value of the wrong type, then out of range)
+func (e ConfigErrors) add(errs ...ConfigError) ConfigErrors {
+	for _, err := range errs {
+		found := false
+		for _, prev := range e {
+			if err.Field != "" && prev.Field == err.Field {
+				found = true
+				break
+			}
+		}
+		if !found {
+			e = append(e, err)
+		}
+	}
+	return e
+}
+
+/*
+LoadConfiguration loads the configuration file and returns the corresponding object.
+The format of the file (JSON, YAML or TOML) is detected from its extension. The ${VAR} and ${VAR:-default}
+placeholders in the values are replaced with the environment variables, then the FTPC_ environment variables
+override the settings of the file (see ApplyEnvOverrides).
+The file is checked strictly: unknown keys, syntax errors and wrong types are reported with their position,
+the fields omitted get their default value and the values are validated (see ValidateConfiguration).
+All the problems found are returned as ConfigErrors.
+*/
+func LoadConfiguration(file string) (model.Config, error) {
+	var config model.Config
+	format, err := ConfigFormat(file)
+	if err != nil {
+		return config, err
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return config, err
+	}
+	tree, pos, errs := parseConfig(b, format)
+	if len(errs) > 0 {
+		return config, errs
+	}
+	// the errors are collected, so that all the problems of the file are reported at once: the unknown fields
+	// and the values of the wrong type are ignored by the decoding, the rest of the configuration is validated
+	tree, errs = normalize(tree, reflect.TypeOf(config), "", pos)
+	tree, envErrs := ApplyEnvOverrides(tree, os.Environ())
+	errs = errs.add(envErrs...)
+	// the tree contains only maps, slices and scalar values, so it's decoded as a JSON document
+	b, err = json.Marshal(tree)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		errs = errs.add(decodeError(err, pos))
+	}
+	ApplyDefaults(&config)
+	errs = errs.add(validateConfiguration(config, pos, explicitZeros(tree, "", nil))...)
+	if len(errs) > 0 {
+		return config, errs
+	}
+	return config, nil
+}
+
+// ApplyDefaults sets the default value of the fields omitted (or set to 0) in the configuration
+func ApplyDefaults(config *model.Config) {
+	setDefault(&config.Log.Size, defaultLogSize)
+	setDefault(&config.Log.Backups, defaultLogBackups)
+	setDefault(&config.Log.Age, defaultLogAge)
+	setDefault(&config.HTTP.StaleAfter, defaultStaleAfter)
+	for i := range config.Servers {
+		s := &config.Servers[i]
+		setDefault(&s.Sampling, defaultSampling)
+		setDefault(&s.RetryConnection, defaultRetryConnection)
+		if s.FileExtension == "" {
+			s.FileExtension = "*"
+		}
+	}
+	cs := &config.CloudStorage
+	setDefault(&cs.RetryConnection, defaultRetryConnection)
+	setDefault(&cs.RetryUpload, defaultRetryUpload)
+	setDefault(&cs.FileUploadAttempts, defaultUploadAttempts)
+	setDefault(&cs.ConnectionAttempts, defaultConnectionAttempts)
+	setDefault(&cs.MaxResumes, defaultMaxResumes)
+	setDefault(&config.State.HistoryLimit, defaultHistoryLimit)
+	for i := range config.Webhooks {
+		w := &config.Webhooks[i]
+		setDefault(&w.Timeout, defaultWebhookTimeout)
+		setDefault(&w.MaxAttempts, defaultWebhookAttempts)
+		setDefault(&w.Retry, defaultWebhookRetry)
+	}
+	if s := config.SMTP; s != nil {
+		if s.Security == model.SMTPTLS {
+			setDefault(&s.Port, defaultSMTPTLSPort)
+		}
+		setDefault(&s.Port, defaultSMTPPort)
+		setDefault(&s.Timeout, defaultSMTPTimeout)
+		setDefault(&s.MaxPerHour, defaultMailsPerHour)
+	}
+	for i := range config.Alerts {
+		a := &config.Alerts[i]
+		setDefault(&a.After, defaultAlertAfter)
+		setDefault(&a.MinInterval, defaultAlertInterval)
+	}
+}
+
+func setDefault(v *int, def int) {
+	if *v == 0 {
+		*v = def
+	}
+}
+
+// ValidateConfiguration checks the values of the configuration (with the defaults already applied)
+func ValidateConfiguration(config model.Config) error {
+	if errs := validateConfiguration(config, nil, nil); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+/*
+validateConfiguration checks the values of the configuration. The fields in zeros were set to 0 in the file (their
+default was applied as for the ones omitted): a 0 out of the range of the field is reported, instead of the default.
+*/
+func validateConfiguration(config model.Config, pos *positions, zeros map[string]bool) ConfigErrors {
+	v := &validator{pos: pos, zeros: zeros}
+	if len(config.Servers) == 0 {
+		v.add("servers", "at least a server is required")
+	}
+	ids := make(map[string]string)   // key: source ID, value: field of the server
+	names := make(map[string]string) // key: server_name, value: field of the server
+	for i, s := range config.Servers {
+		p := fmt.Sprintf("servers[%d]", i)
+		v.required(p+".host", s.Host)
+		v.rangeInt(p+".port", s.Port, 0, 65535)
+		v.rangeInt(p+".sampling", s.Sampling, minInterval, -1)
+		v.rangeInt(p+".retry_conn", s.RetryConnection, minInterval, -1)
+
+		id := SourceID(s)
+		if !validSourceID(id) {
+			v.add(p+".id", fmt.Sprintf("invalid id %q (allowed characters: letters, digits, '.', '_' and '-')", id))
+		} else if other, ok := ids[id]; ok {
+			// two servers with the same ID would share their state and overwrite each other's files
+			v.add(p+".id", fmt.Sprintf("same id %q of %s: set a different \"id\" for each server", id, other))
+		}
+		ids[id] = p
+		if s.ServerName != "" {
+			if other, ok := names[s.ServerName]; ok {
+				v.add(p+".server_name", fmt.Sprintf("same server_name %q of %s", s.ServerName, other))
+			}
+			names[s.ServerName] = p
+		}
+
+		v.oneOf(p+".direction", s.Direction, "", DirectionPull, DirectionPush, DirectionBoth)
+		if PushEnabled(s) && s.Push.LocalDir == "" && s.Push.BucketPrefix == "" {
+			v.add(p+".push", "local_dir or bucket_prefix is required")
+		}
+		if (s.Direction == DirectionPush || s.Direction == DirectionBoth) && s.Push == nil {
+			v.add(p+".push", "required when direction is "+s.Direction)
+		}
+		if a := s.PostAction; a != nil {
+			v.oneOf(p+".post_action.action", a.Action, "", PostActionDelete, PostActionMove, PostActionRename)
+			if a.Action == PostActionMove {
+				v.required(p+".post_action.archive_dir", a.ArchiveDir)
+			}
+			if a.Action == PostActionRename {
+				v.required(p+".post_action.suffix", a.Suffix)
+			}
+			v.rangeInt(p+".post_action.max_per_cycle", a.MaxPerCycle, 0, -1)
+		}
+		if m := s.Mirror; m != nil {
+			v.rangeInt(p+".mirror.missing_listings", m.MissingListings, 0, -1)
+			v.oneOf(p+".mirror.local", m.Local, "", MirrorKeep, MirrorDelete, MirrorMove)
+			v.oneOf(p+".mirror.bucket", m.Bucket, "", MirrorKeep, MirrorDelete, MirrorMove)
+			if m.Local == MirrorMove {
+				v.required(p+".mirror.local_archive_dir", m.LocalArchiveDir)
+			}
+			if m.Bucket == MirrorMove {
+				v.required(p+".mirror.bucket_archive_prefix", m.BucketArchivePrefix)
+			}
+		}
+		v.compression(p+".compression", s.Compression)
+		v.encryption(p+".encryption", s.Encryption)
+		if s.Schedule != nil {
+			if _, err := NewScheduler(s); err != nil {
+				v.add(p+".schedule", err.Error())
+			}
+		}
+		// the secret referenced by the password must be available (its value is never reported)
+		if _, _, err := FTPCredentials(s); err != nil {
+			v.add(p+".password", err.Error())
+		}
+	}
+
+	cs := config.CloudStorage
+	if cs.BucketName != "" {
+		// the credentials are needed only if the files are uploaded to a bucket
+		v.credentials("cloud_storage.credentials_path", cs.CredentialsPath)
+	}
+	v.rangeInt("cloud_storage.retry_conn", cs.RetryConnection, minInterval, -1)
+	v.rangeInt("cloud_storage.retry_upload", cs.RetryUpload, 0, -1)
+	v.rangeInt("cloud_storage.file_upload_attempts", cs.FileUploadAttempts, 1, maxAttempts)
+	v.rangeInt("cloud_storage.connection_attempts", cs.ConnectionAttempts, 1, maxAttempts)
+	v.rangeInt("cloud_storage.chunk_size", cs.ChunkSize, 0, -1)
+	v.rangeInt("cloud_storage.upload_timeout", cs.UploadTimeout, 0, -1)
+	v.rangeInt("cloud_storage.min_throughput", cs.MinThroughput, 0, -1)
+	v.rangeInt("cloud_storage.max_resumes", cs.MaxResumes, 1, maxAttempts)
+	v.compression("cloud_storage.compression", cs.Compression)
+	v.encryption("encryption", config.Encryption)
+
+	v.rangeInt("log.size", config.Log.Size, 1, -1)
+	v.rangeInt("log.backups", config.Log.Backups, 0, -1)
+	v.rangeInt("log.age", config.Log.Age, 0, -1)
+	v.oneOf("log.level", config.Log.Level, "", "debug", "info", "warn", "error")
+	v.oneOf("log.format", config.Log.Format, "", LogFormatText, LogFormatJSON)
+	v.oneOf("state.backend", config.State.Backend, "", state.BackendBolt, state.BackendJSON)
+	v.rangeInt("state.history_limit", config.State.HistoryLimit, 1, -1)
+	if listen := config.HTTP.Listen; listen != "" {
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			v.add("http.listen", fmt.Sprintf("invalid address %q (e.g. \":9090\", \"127.0.0.1:9090\")", listen))
+		}
+	}
+	v.rangeInt("http.stale_after", config.HTTP.StaleAfter, 1000, -1)
+	if config.HTTP.AdminToken != "" {
+		if _, err := ResolveSecret(string(config.HTTP.AdminToken)); err != nil {
+			v.add("http.admin_token", err.Error())
+		}
+	}
+	for i, w := range config.Webhooks {
+		p := fmt.Sprintf("webhooks[%d]", i)
+		if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add(p+".url", fmt.Sprintf("invalid URL %q (e.g. \"https://example.com/hooks/ftpc\")", w.URL))
+		}
+		if w.Secret != "" {
+			if _, err := ResolveSecret(string(w.Secret)); err != nil {
+				v.add(p+".secret", err.Error())
+			}
+		}
+		for j, e := range w.Events {
+			v.oneOf(fmt.Sprintf("%s.events[%d]", p, j), e, events.Types...)
+		}
+		v.rangeInt(p+".timeout", w.Timeout, minInterval, -1)
+		v.rangeInt(p+".max_attempts", w.MaxAttempts, 1, maxAttempts)
+		v.rangeInt(p+".retry", w.Retry, minInterval, -1)
+	}
+	if s := config.SMTP; s != nil {
+		v.required("smtp.host", s.Host)
+		v.rangeInt("smtp.port", s.Port, 1, 65535)
+		v.address("smtp.from", s.From)
+		v.oneOf("smtp.security", s.Security, "", model.SMTPStartTLS, model.SMTPTLS, model.SMTPNone)
+		if s.Password != "" {
+			if _, err := ResolveSecret(string(s.Password)); err != nil {
+				v.add("smtp.password", err.Error())
+			}
+		}
+		v.rangeInt("smtp.timeout", s.Timeout, minInterval, -1)
+		v.rangeInt("smtp.max_per_hour", s.MaxPerHour, 1, -1)
+	} else if len(config.Alerts) > 0 {
+		v.add("smtp", "required to send the alerts")
+	}
+	for i, a := range config.Alerts {
+		p := fmt.Sprintf("alerts[%d]", i)
+		v.oneOf(p+".event", a.Event, events.ServerUnreachable, events.UploadDisabled)
+		for j, id := range a.Servers {
+			if _, ok := ids[id]; !ok {
+				v.add(fmt.Sprintf("%s.servers[%d]", p, j), fmt.Sprintf("unknown server id %q", id))
+			}
+		}
+		if len(a.To) == 0 {
+			v.add(p+".to", "at least a recipient is required")
+		}
+		for j, to := range a.To {
+			v.address(fmt.Sprintf("%s.to[%d]", p, j), to)
+		}
+		v.rangeInt(p+".after", a.After, 0, -1)
+		v.rangeInt(p+".min_interval", a.MinInterval, 0, -1)
+	}
+	return v.errs
+}
+
+// validator collects the problems found validating the configuration
+type validator struct {
+	pos   *positions
+	zeros map[string]bool // fields set to 0 in the file (see explicitZeros)
+	errs  ConfigErrors
+}
+
+func (v *validator) add(field, msg string) {
+	line, col := v.pos.lookup(field)
+	v.errs = append(v.errs, ConfigError{Field: field, Line: line, Column: col, Msg: msg})
+}
+
+func (v *validator) required(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		v.add(field, "required")
+	}
+}
+
+// rangeInt checks that min <= value <= max (a negative max means no upper limit)
+func (v *validator) rangeInt(field string, value, min, max int) {
+	if v.zeros[field] {
+		value = 0 // not the default
+	}
+	if value < min {
+		v.add(field, fmt.Sprintf("must be at least %d (found %d)", min, value))
+	} else if max >= 0 && value > max {
+		v.add(field, fmt.Sprintf("must be at most %d (found %d)", max, value))
+	}
+}
+
+// address checks an email address, e.g. "ftpc@example.com" or "FTP connector <ftpc@example.com>"
+func (v *validator) address(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		v.add(field, "required")
+	} else if _, err := mail.ParseAddress(value); err != nil {
+		v.add(field, fmt.Sprintf("invalid address %q", value))
+	}
+}
+
+func (v *validator) oneOf(field, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	var quoted []string
+	for _, a := range allowed {
+		if a != "" {
+			quoted = append(quoted, fmt.Sprintf("%q", a))
+		}
+	}
+	v.add(field, fmt.Sprintf("unknown value %q (allowed: %s)", value, strings.Join(quoted, ", ")))
+}
+
+func (v *validator) fileExists(field, path string) {
+	if path == "" {
+		v.add(field, "required")
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		v.add(field, fmt.Sprintf("file not found: %s", path))
+	}
+}
+
+// credentials checks that the Cloud Storage credentials (a file or a secret reference) are available
+func (v *validator) credentials(field, path string) {
+	if strings.HasPrefix(path, model.SecretEnv) {
+		if _, err := ResolveSecret(path); err != nil {
+			v.add(field, err.Error())
+		}
+		return
+	}
+	v.fileExists(field, strings.TrimPrefix(path, model.SecretFile))
+}
+
+func (v *validator) compression(field string, c *model.Compression) {
+	if c == nil {
+		return
+	}
+	v.oneOf(field+".algorithm", c.Algorithm, "", "none", CompressionGzip, CompressionZstd)
+	switch c.Algorithm {
+	case CompressionGzip:
+		v.rangeInt(field+".level", c.Level, -2, 9)
+	case CompressionZstd:
+		v.rangeInt(field+".level", c.Level, 0, 22)
+	}
+}
+
+func (v *validator) encryption(field string, e *model.Encryption) {
+	if e == nil || e.KeyFile == "" {
+		return
+	}
+	if _, err := LoadEncryptionKey(e.KeyFile); err != nil {
+		v.add(field+".key_file", err.Error())
+	}
+	if len(e.KeyID) > 255 {
+		v.add(field+".key_id", "must be at most 255 characters")
+	}
+}
+
+// index of an array in the path of a field reported by encoding/json (e.g. "servers.0.host")
+var arrayIndex = regexp.MustCompile(`\.(\d+)\b`)
+
+/*
+decodeError converts an error of json.Unmarshal to a ConfigError with the position of the problem.
+The document decoded is the one built from the file, so the position of a wrong type is the one of its field.
+*/
+func decodeError(err error, pos *positions) ConfigError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		field := arrayIndex.ReplaceAllString(typeErr.Field, "[$1]")
+		line, col := pos.lookup(field)
+		return ConfigError{Field: field, Line: line, Column: col, Msg: fmt.Sprintf("expected %s, found %s", typeErr.Type, typeErr.Value)}
+	}
+	return ConfigError{Msg: err.Error()}
+}
+
+/*
+normalize walks the tree parsed from the configuration file and returns it ready to be decoded:
+the placeholders in the strings are replaced (see interpolate) and a string whose field is a number or a boolean is
+converted (e.g. "sampling": "${SAMPLING:-1000}"). The keys that don't match any field of the configuration
+(e.g. typos) are reported.
+*/
+func normalize(node interface{}, t reflect.Type, path string, pos *positions) (interface{}, ConfigErrors) {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var errs ConfigErrors
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			child := joinField(path, key)
+			var ft reflect.Type
+			if t != nil {
+				switch t.Kind() {
+				case reflect.Struct:
+					if f, ok := fieldByJSONName(t, key); ok {
+						ft = f.Type
+					} else {
+						line, col := pos.lookup(child)
+						errs = append(errs, ConfigError{Field: child, Line: line, Column: col, Msg: "unknown field"})
+					}
+				case reflect.Map:
+					ft = t.Elem()
+				}
+			}
+			var e ConfigErrors
+			v[key], e = normalize(value, ft, child, pos)
+			errs = append(errs, e...)
+		}
+	case []interface{}:
+		var et reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			et = t.Elem()
+		}
+		for i, value := range v {
+			var e ConfigErrors
+			v[i], e = normalize(value, et, fmt.Sprintf("%s[%d]", path, i), pos)
+			errs = append(errs, e...)
+		}
+	case string:
+		s := interpolate(v, os.LookupEnv)
+		if t == nil || t.Kind() == reflect.String || s == v {
+			return s, nil
+		}
+		// the type of a value without placeholders is checked by json.Unmarshal
+		value, err := scalarValue(s, t)
+		if err != nil {
+			line, col := pos.lookup(path)
+			return s, ConfigErrors{{Field: path, Line: line, Column: col, Msg: err.Error()}}
+		}
+		return value, nil
+	}
+	return node, errs
+}
+
+// joinField returns the path of the key of the object at the given path (e.g. servers[0].sampling)
+func joinField(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// explicitZeros adds to the set the paths of the numbers set to 0 in the configuration tree (e.g. servers[0].sampling)
+func explicitZeros(node interface{}, path string, zeros map[string]bool) map[string]bool {
+	if zeros == nil {
+		zeros = make(map[string]bool)
+	}
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			explicitZeros(value, joinField(path, key), zeros)
+		}
+	case []interface{}:
+		for i, value := range v {
+			explicitZeros(value, fmt.Sprintf("%s[%d]", path, i), zeros)
+		}
+	case json.Number, int, int64, uint64, float64: // JSON and env overrides, YAML, TOML
+		if f, err := strconv.ParseFloat(fmt.Sprint(v), 64); err == nil && f == 0 {
+			zeros[path] = true
+		}
+	}
+	return zeros
+}
+
+// fieldByJSONName returns the field of the struct with the given JSON name
+func fieldByJSONName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == name || (tag == "" && f.Name == name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// positions maps the fields of the configuration file (e.g. servers[0].sampling) to their line and column
+type positions struct {
+	fields map[string]position
+}
+
+type position struct {
+	line, col int
+}
+
+func newPositions() *positions {
+	return &positions{fields: make(map[string]position)}
+}
+
+func (p *positions) set(field string, line, col int) {
+	p.fields[field] = position{line, col}
+}
+
+// lookup returns the line and column of the field (or of its closest parent in the file), 0 if unknown
+func (p *positions) lookup(field string) (int, int) {
+	if p == nil {
+		return 0, 0
+	}
+	for field != "" {
+		if pos, ok := p.fields[field]; ok {
+			return pos.line, pos.col
+		}
+		i := strings.LastIndexAny(field, ".[")
+		if i < 0 {
+			break
+		}
+		field = field[:i]
+	}
+	return 0, 0
+}
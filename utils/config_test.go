@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLoadConfigurationErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		server string // JSON of the server
+		fields []string
+	}{
+		{"valid", `{"host": "10.0.0.1", "sampling": 1000}`, nil},
+		{"unknown field and out of range", `{"host": "10.0.0.1", "smapling": 1000, "port": 70000}`,
+			[]string{"servers[0].port", "servers[0].smapling"}},
+		{"placeholder not a number and out of range", `{"host": "10.0.0.1", "sampling": "${TEST_UNSET_SAMPLING}", "retry_conn": 10}`,
+			[]string{"servers[0].retry_conn", "servers[0].sampling"}},
+		{"wrong type and required", `{"sampling": "fast"}`, []string{"servers[0].host", "servers[0].sampling"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(file, []byte(`{"servers": [`+tt.server+`]}`), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadConfiguration(file)
+			var errs ConfigErrors
+			if err != nil && !errors.As(err, &errs) {
+				t.Fatalf("LoadConfiguration: %v, want ConfigErrors", err)
+			}
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.Field)
+			}
+			sort.Strings(fields)
+			// each field is reported once, with all the others
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("errors on %v, want %v\n%v", fields, tt.fields, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,440 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ftp-client/model"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// formats of the configuration file
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// prefix of the environment variables that override the settings of the configuration file
+const EnvPrefix = "FTPC_"
+
+// DefaultConfigFiles are the configuration files looked for (in this order) if none is given
+var DefaultConfigFiles = []string{"auth/conf.json", "auth/conf.yaml", "auth/conf.yml", "auth/conf.toml"}
+
+// DefaultConfigFile returns the first of DefaultConfigFiles that exists (auth/conf.json if none does)
+func DefaultConfigFile() string {
+	for _, f := range DefaultConfigFiles {
+		if _, err := os.Stat(f); err == nil {
+			return f
+		}
+	}
+	return DefaultConfigFiles[0]
+}
+
+// ConfigFormat returns the format of the configuration file from its extension
+func ConfigFormat(file string) (string, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return FormatJSON, nil
+	case ".yaml", ".yml":
+		return FormatYAML, nil
+	case ".toml":
+		return FormatTOML, nil
+	}
+	return "", fmt.Errorf("unknown format of the configuration file %s (allowed extensions: .json, .yaml, .yml, .toml)", file)
+}
+
+/*
+parseConfig parses the configuration file in a tree of maps, slices and scalar values, and returns the position
+of its fields (only for JSON and YAML: the TOML parser doesn't report them).
+*/
+func parseConfig(data []byte, format string) (interface{}, *positions, ConfigErrors) {
+	var tree interface{}
+	var pos *positions
+	var err ConfigErrors
+	switch format {
+	case FormatJSON:
+		tree, pos, err = parseJSON(data)
+	case FormatYAML:
+		tree, pos, err = parseYAML(data)
+	case FormatTOML:
+		tree, pos, err = parseTOML(data)
+	default:
+		return nil, nil, ConfigErrors{{Msg: "unknown format " + format}}
+	}
+	if len(err) > 0 {
+		return nil, nil, err
+	}
+	if tree == nil {
+		return map[string]interface{}{}, pos, nil
+	}
+	if _, ok := tree.(map[string]interface{}); !ok {
+		return nil, nil, ConfigErrors{{Line: 1, Column: 1, Msg: "the configuration must be an object"}}
+	}
+	return tree, pos, nil
+}
+
+func parseJSON(data []byte) (interface{}, *positions, ConfigErrors) {
+	var tree interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // the numbers are kept as they are written
+	if err := dec.Decode(&tree); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line, col := offsetPosition(data, syntaxErr.Offset)
+			return nil, nil, ConfigErrors{{Line: line, Column: col, Msg: syntaxErr.Error()}}
+		}
+		if err == io.EOF {
+			return nil, nil, nil // empty file
+		}
+		return nil, nil, ConfigErrors{{Msg: err.Error()}}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		line, col := offsetPosition(data, dec.InputOffset())
+		return nil, nil, ConfigErrors{{Line: line, Column: col, Msg: "unexpected data after the end of the configuration"}}
+	}
+	pos := newPositions()
+	jsonPositions(data, pos)
+	return tree, pos, nil
+}
+
+// jsonPositions saves the position of the keys and of the array items of the JSON document (already validated)
+func jsonPositions(data []byte, pos *positions) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// skip returns the offset of the first token after the given offset (skipping spaces and separators)
+	skip := func(offset int64) int64 {
+		for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+			offset++
+		}
+		return offset
+	}
+	set := func(field string, offset int64) {
+		line, col := offsetPosition(data, skip(offset))
+		pos.set(field, line, col)
+	}
+	var walk func(path string) error
+	walk = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				offset := dec.InputOffset()
+				tok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				child := joinField(path, tok.(string))
+				set(child, offset)
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token() // closing "}"
+			return err
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				child := fmt.Sprintf("%s[%d]", path, i)
+				set(child, dec.InputOffset())
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token() // closing "]"
+			return err
+		}
+		return nil
+	}
+	walk("")
+}
+
+// offsetPosition returns the line and column (starting from 1) of the given offset of the data
+func offsetPosition(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// line of the errors of the YAML parser (e.g. "yaml: line 3: mapping values are not allowed in this context")
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+func parseYAML(data []byte) (interface{}, *positions, ConfigErrors) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return nil, nil, ConfigErrors{{Line: line, Column: 1, Msg: m[2]}}
+		}
+		return nil, nil, ConfigErrors{{Msg: err.Error()}}
+	}
+	pos := newPositions()
+	tree, err := yamlTree(&doc, "", pos)
+	if err != nil {
+		return nil, nil, ConfigErrors{*err}
+	}
+	return tree, pos, nil
+}
+
+// yamlTree converts the YAML node to a tree of maps, slices and scalar values, saving the position of its fields
+func yamlTree(n *yaml.Node, path string, pos *positions) (interface{}, *ConfigError) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil, nil
+		}
+		return yamlTree(n.Content[0], path, pos)
+	case yaml.AliasNode:
+		return yamlTree(n.Alias, path, pos)
+	case yaml.MappingNode:
+		m := make(map[string]interface{}, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Kind != yaml.ScalarNode {
+				return nil, &ConfigError{Field: path, Line: k.Line, Column: k.Column, Msg: "the keys must be strings"}
+			}
+			child := joinField(path, k.Value)
+			pos.set(child, k.Line, k.Column)
+			value, err := yamlTree(v, child, pos)
+			if err != nil {
+				return nil, err
+			}
+			m[k.Value] = value
+		}
+		return m, nil
+	case yaml.SequenceNode:
+		s := make([]interface{}, len(n.Content))
+		for i, item := range n.Content {
+			child := fmt.Sprintf("%s[%d]", path, i)
+			pos.set(child, item.Line, item.Column)
+			value, err := yamlTree(item, child, pos)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = value
+		}
+		return s, nil
+	}
+	var value interface{}
+	if err := n.Decode(&value); err != nil {
+		return nil, &ConfigError{Field: path, Line: n.Line, Column: n.Column, Msg: err.Error()}
+	}
+	return value, nil
+}
+
+// line of the errors of the TOML parser (e.g. `toml: line 3 (last key "servers.host"): expected value but found '\n' instead`)
+var tomlErrorLine = regexp.MustCompile(`^toml: line \d+(?: \(last key "[^"]*"\))?: (.*)$`)
+
+func parseTOML(data []byte) (interface{}, *positions, ConfigErrors) {
+	var tree map[string]interface{}
+	if err := toml.Unmarshal(data, &tree); err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			msg := parseErr.Error()
+			if m := tomlErrorLine.FindStringSubmatch(msg); m != nil {
+				msg = m[1]
+			}
+			return nil, nil, ConfigErrors{{Field: parseErr.LastKey, Line: parseErr.Position.Line, Column: 1, Msg: msg}}
+		}
+		return nil, nil, ConfigErrors{{Msg: err.Error()}}
+	}
+	return tomlTree(tree), nil, nil
+}
+
+// tomlTree converts the arrays of tables (decoded as []map[string]interface{}) to plain slices, like the other formats
+func tomlTree(node interface{}) interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = tomlTree(value)
+		}
+	case []map[string]interface{}:
+		s := make([]interface{}, len(v))
+		for i, m := range v {
+			s[i] = tomlTree(m)
+		}
+		return s
+	case []interface{}:
+		for i, value := range v {
+			v[i] = tomlTree(value)
+		}
+	}
+	return node
+}
+
+// placeholders of the environment variables in the values: ${VAR}, ${VAR:-default} and $$ (a literal "$")
+var placeholder = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+/*
+interpolate replaces the placeholders in the string: ${VAR} with the value of the environment variable VAR
+(empty if it's not set) and ${VAR:-default} with the default if VAR is not set or empty. "$$" is a literal "$".
+*/
+func interpolate(s string, lookup func(string) (string, bool)) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	return placeholder.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+		sub := placeholder.FindStringSubmatch(m)
+		value, ok := lookup(sub[1])
+		if (!ok || value == "") && sub[2] != "" {
+			return sub[3]
+		}
+		return value
+	})
+}
+
+// scalarValue converts the string to the value of a field of the given type
+func scalarValue(s string, t reflect.Type) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	switch t.Kind() {
+	case reflect.String:
+		return s, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, err := strconv.ParseInt(s, 10, t.Bits()); err != nil {
+			return nil, fmt.Errorf("expected %s, found %q", t, s)
+		}
+		return json.Number(s), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, err := strconv.ParseUint(s, 10, t.Bits()); err != nil {
+			return nil, fmt.Errorf("expected %s, found %q", t, s)
+		}
+		return json.Number(s), nil
+	case reflect.Float32, reflect.Float64:
+		if _, err := strconv.ParseFloat(s, t.Bits()); err != nil {
+			return nil, fmt.Errorf("expected %s, found %q", t, s)
+		}
+		return json.Number(s), nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("expected bool, found %q", s)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("expected %s, found a string", t.Kind())
+}
+
+/*
+ApplyEnvOverrides sets the fields of the configuration tree from the environment variables starting with FTPC_.
+The rest of the name is the path of the field, with "_" in place of the dots and the JSON names in upper case:
+e.g. FTPC_SERVERS_0_SAMPLING=5000 sets servers[0].sampling and FTPC_CLOUD_STORAGE_BUCKET_NAME sets
+cloud_storage.bucket_name. The index of the servers can be the next one, to add a server.
+The values are used as they are (no placeholders) and converted to the type of the field.
+The variables are applied sorted by their path (the indexes compared as numbers), so that the servers can be added
+in any order of the environment. An environment variable that doesn't match any field is reported, so that a typo
+is not ignored.
+*/
+func ApplyEnvOverrides(tree interface{}, environ []string) (interface{}, ConfigErrors) {
+	type override struct {
+		name, value string
+		tokens      []string
+	}
+	var overrides []override
+	for _, env := range environ {
+		name, value, ok := strings.Cut(env, "=")
+		if !ok || !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		tokens := strings.Split(strings.ToLower(strings.TrimPrefix(name, EnvPrefix)), "_")
+		overrides = append(overrides, override{name, value, tokens})
+	}
+	sort.SliceStable(overrides, func(i, j int) bool {
+		return lessTokens(overrides[i].tokens, overrides[j].tokens)
+	})
+
+	var errs ConfigErrors
+	for _, o := range overrides {
+		t, err := setField(tree, reflect.TypeOf(model.Config{}), o.tokens, o.value, "")
+		if err != nil {
+			errs = append(errs, ConfigError{Field: o.name, Msg: err.Error()})
+			continue
+		}
+		tree = t
+	}
+	return tree, errs
+}
+
+// lessTokens compares the tokens of the names of two environment variables: the numbers (indexes) as numbers
+func lessTokens(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		x, errX := strconv.Atoi(a[i])
+		y, errY := strconv.Atoi(b[i])
+		if errX == nil && errY == nil {
+			return x < y
+		}
+		return a[i] < b[i]
+	}
+	return len(a) < len(b)
+}
+
+/*
+setField sets the field at the path given by the tokens of the name of an environment variable. The JSON names
+contain "_" as well, so the longest name matching the first tokens is used (e.g. "retry", "conn" is retry_conn).
+*/
+func setField(node interface{}, t reflect.Type, tokens []string, value, path string) (interface{}, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if len(tokens) == 0 {
+		return scalarValue(value, t)
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, _ := node.(map[string]interface{})
+		if m == nil {
+			m = make(map[string]interface{})
+		}
+		for n := len(tokens); n > 0; n-- {
+			key := strings.Join(tokens[:n], "_")
+			if f, ok := fieldByJSONName(t, key); ok {
+				v, err := setField(m[key], f.Type, tokens[n:], value, joinField(path, key))
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+				return m, nil
+			}
+		}
+	case reflect.Slice:
+		s, _ := node.([]interface{})
+		i, err := strconv.Atoi(tokens[0])
+		if err != nil || i < 0 || i > len(s) {
+			return nil, fmt.Errorf("invalid index %q of %s (%d items)", tokens[0], path, len(s))
+		}
+		if i == len(s) {
+			s = append(s, nil)
+		}
+		v, err := setField(s[i], t.Elem(), tokens[1:], value, fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		s[i] = v
+		return s, nil
+	}
+	if path == "" {
+		return nil, fmt.Errorf("unknown setting %q", strings.Join(tokens, "_"))
+	}
+	return nil, fmt.Errorf("unknown setting %q of %s", strings.Join(tokens, "_"), path)
+}
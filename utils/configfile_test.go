@@ -0,0 +1,280 @@
+package utils
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{"HOST": "10.0.0.1", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"${HOST}", "10.0.0.1"},
+		{"ftp://${HOST}:21", "ftp://10.0.0.1:21"},
+		{"${MISSING}", ""},
+		{"${MISSING:-default}", "default"},
+		{"${EMPTY:-default}", "default"},
+		{"${HOST:-default}", "10.0.0.1"},
+		{"${MISSING:-}", ""},
+		{"$$HOST", "$HOST"},
+		{"$${HOST}", "${HOST}"},
+		{"cost: 5$", "cost: 5$"},
+		{"${1INVALID}", "${1INVALID}"},
+		{"${HOST}-${MISSING:-x}", "10.0.0.1-x"},
+	}
+	for _, tt := range tests {
+		if got := interpolate(tt.in, lookup); got != tt.want {
+			t.Errorf("interpolate(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestScalarValue(t *testing.T) {
+	tests := []struct {
+		in      string
+		typ     interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{"5000", 0, json.Number("5000"), false},
+		{" 5000 ", 0, json.Number("5000"), false},
+		{"-1", 0, json.Number("-1"), false},
+		{"5s", 0, nil, true},
+		{"", 0, nil, true},
+		{"42", uint64(0), json.Number("42"), false},
+		{"-1", uint64(0), nil, true},
+		{"300", int8(0), nil, true},
+		{"1.5", 0.0, json.Number("1.5"), false},
+		{"x", 0.0, nil, true},
+		{"true", false, true, false},
+		{"0", false, false, false},
+		{"yes", false, nil, true},
+		{"text", "", "text", false},
+		{"a,b", []string{}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := scalarValue(tt.in, reflect.TypeOf(tt.typ))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("scalarValue(%q, %T) error = %v, want error %v", tt.in, tt.typ, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("scalarValue(%q, %T) = %#v, want %#v", tt.in, tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestSetField(t *testing.T) {
+	tests := []struct {
+		name    string
+		tree    string // JSON of the tree
+		env     string // name of the variable, without the prefix
+		value   string
+		want    string // JSON of the tree after the override
+		wantErr string
+	}{
+		{"top level", `{}`, "CLOUD_STORAGE_BUCKET_NAME", "b", `{"cloud_storage":{"bucket_name":"b"}}`, ""},
+		{"longest name", `{"servers":[{"host":"h"}]}`, "SERVERS_0_RETRY_CONN", "500", `{"servers":[{"host":"h","retry_conn":500}]}`, ""},
+		{"replace", `{"servers":[{"host":"h","sampling":1000}]}`, "SERVERS_0_SAMPLING", "5000", `{"servers":[{"host":"h","sampling":5000}]}`, ""},
+		{"append", `{"servers":[{"host":"h"}]}`, "SERVERS_1_HOST", "h2", `{"servers":[{"host":"h"},{"host":"h2"}]}`, ""},
+		{"pointer", `{}`, "SMTP_PORT", "25", `{"smtp":{"port":25}}`, ""},
+		{"bool", `{}`, "CLOUD_STORAGE_CREATE_ONLY", "true", `{"cloud_storage":{"create_only":true}}`, ""},
+		{"index out of range", `{"servers":[{"host":"h"}]}`, "SERVERS_2_HOST", "h3", "", `invalid index "2" of servers (1 items)`},
+		{"invalid index", `{}`, "SERVERS_X_HOST", "h", "", `invalid index "x" of servers (0 items)`},
+		{"unknown", `{}`, "SERVERS_0_HOSTNAME", "h", "", `unknown setting "hostname" of servers[0]`},
+		{"unknown top level", `{}`, "NOPE", "1", "", `unknown setting "nope"`},
+		{"wrong type", `{}`, "LOG_SIZE", "big", "", `expected int, found "big"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tree interface{}
+			if err := json.Unmarshal([]byte(tt.tree), &tree); err != nil {
+				t.Fatal(err)
+			}
+			got, errs := ApplyEnvOverrides(tree, []string{EnvPrefix + tt.env + "=" + tt.value})
+			if tt.wantErr != "" {
+				if len(errs) != 1 || errs[0].Msg != tt.wantErr {
+					t.Fatalf("errors = %v, want %q", errs, tt.wantErr)
+				}
+				return
+			}
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			b, _ := json.Marshal(got)
+			if !jsonEqual(t, string(b), tt.want) {
+				t.Errorf("tree = %s, want %s", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyEnvOverridesOrder(t *testing.T) {
+	environ := []string{
+		"FTPC_SERVERS_3_HOST=h4",
+		"PATH=/bin",
+		"FTPC_SERVERS_10_HOST=h11",
+		"FTPC_SERVERS_2_HOST=h3",
+		"FTPC_SERVERS_2_SAMPLING=2000",
+	}
+	tree := map[string]interface{}{"servers": []interface{}{map[string]interface{}{"host": "h1"}, map[string]interface{}{"host": "h2"}}}
+	got, errs := ApplyEnvOverrides(tree, environ)
+	// the servers are added in the order of their index, whatever the order of the environment
+	if len(errs) != 1 || errs[0].Field != "FTPC_SERVERS_10_HOST" {
+		t.Fatalf("errors = %v, want only FTPC_SERVERS_10_HOST", errs)
+	}
+	b, _ := json.Marshal(got)
+	want := `{"servers":[{"host":"h1"},{"host":"h2"},{"host":"h3","sampling":2000},{"host":"h4"}]}`
+	if !jsonEqual(t, string(b), want) {
+		t.Errorf("tree = %s, want %s", b, want)
+	}
+}
+
+func TestLessTokens(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want bool
+	}{
+		{[]string{"servers", "2", "host"}, []string{"servers", "10", "host"}, true},
+		{[]string{"servers", "10", "host"}, []string{"servers", "2", "host"}, false},
+		{[]string{"servers", "2", "host"}, []string{"servers", "2", "sampling"}, true},
+		{[]string{"log", "size"}, []string{"servers", "0", "host"}, true},
+		{[]string{"servers"}, []string{"servers", "0"}, true},
+		{[]string{"servers", "0"}, []string{"servers", "0"}, false},
+	}
+	for _, tt := range tests {
+		if got := lessTokens(tt.a, tt.b); got != tt.want {
+			t.Errorf("lessTokens(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	const jsonDoc = `{
+  "servers": [
+    {
+      "host": "h",
+      "sampling": 1000
+    }
+  ],
+  "log": {"size": 1}
+}`
+	const yamlDoc = `servers:
+  - host: h
+    sampling: 1000
+log:
+  size: 1
+`
+	tests := []struct {
+		format    string
+		doc       string
+		field     string
+		line, col int
+	}{
+		{FormatJSON, jsonDoc, "servers", 2, 3},
+		{FormatJSON, jsonDoc, "servers[0]", 3, 5},
+		{FormatJSON, jsonDoc, "servers[0].sampling", 5, 7},
+		{FormatJSON, jsonDoc, "log.size", 8, 11},
+		{FormatJSON, jsonDoc, "servers[0].sampling.unknown", 5, 7}, // the closest parent
+		{FormatJSON, jsonDoc, "missing", 0, 0},
+		{FormatYAML, yamlDoc, "servers", 1, 1},
+		{FormatYAML, yamlDoc, "servers[0]", 2, 5},
+		{FormatYAML, yamlDoc, "servers[0].host", 2, 5},
+		{FormatYAML, yamlDoc, "servers[0].sampling", 3, 5},
+		{FormatYAML, yamlDoc, "log.size", 5, 3},
+	}
+	for _, tt := range tests {
+		_, pos, errs := parseConfig([]byte(tt.doc), tt.format)
+		if len(errs) > 0 {
+			t.Fatalf("%s: unexpected errors: %v", tt.format, errs)
+		}
+		if line, col := pos.lookup(tt.field); line != tt.line || col != tt.col {
+			t.Errorf("%s: position of %s = %d:%d, want %d:%d", tt.format, tt.field, line, col, tt.line, tt.col)
+		}
+	}
+}
+
+func TestParseErrorPositions(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		doc    string
+		line   int
+		field  string
+	}{
+		{"json syntax", FormatJSON, "{\n  \"log\": {\"size\": 1,}\n}", 2, ""},
+		{"json trailing data", FormatJSON, "{}\n{}", 2, ""},
+		{"yaml syntax", FormatYAML, "log:\n  size: 1\nservers: a: b\n", 3, ""},
+		{"yaml key", FormatYAML, "log:\n  ? [a]\n  : 1\n", 2, "log"},
+		{"toml syntax", FormatTOML, "[log]\nsize = 1\nage = x\n", 3, "log.age"},
+		{"not an object", FormatJSON, "[1]", 1, ""},
+	}
+	for _, tt := range tests {
+		_, _, errs := parseConfig([]byte(tt.doc), tt.format)
+		if len(errs) != 1 {
+			t.Errorf("%s: errors = %v, want one", tt.name, errs)
+			continue
+		}
+		if errs[0].Line != tt.line || errs[0].Field != tt.field {
+			t.Errorf("%s: error %q at line %d (field %q), want line %d (field %q)", tt.name, errs[0].Msg, errs[0].Line, errs[0].Field, tt.line, tt.field)
+		}
+	}
+}
+
+func TestTOMLTree(t *testing.T) {
+	const doc = `
+[[servers]]
+host = "h1"
+sampling = 1000
+
+[[servers]]
+host = "h2"
+`
+	tree, pos, errs := parseConfig([]byte(doc), FormatTOML)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if pos != nil {
+		t.Errorf("positions = %v, want nil (the TOML parser doesn't report them)", pos)
+	}
+	servers, ok := tree.(map[string]interface{})["servers"].([]interface{})
+	if !ok || len(servers) != 2 {
+		t.Fatalf("servers = %#v, want a slice of 2 items", tree.(map[string]interface{})["servers"])
+	}
+}
+
+func TestExplicitZeros(t *testing.T) {
+	// the numbers of JSON are json.Number, the ones of YAML int or float64, the ones of TOML int64
+	tree := map[string]interface{}{
+		"servers": []interface{}{
+			map[string]interface{}{"sampling": json.Number("0"), "retry_conn": json.Number("500")},
+			map[string]interface{}{"sampling": 0, "port": 21, "host": "0"},
+		},
+		"log":           map[string]interface{}{"size": int64(0), "age": float64(0)},
+		"cloud_storage": map[string]interface{}{"create_only": false},
+	}
+	want := map[string]bool{"servers[0].sampling": true, "servers[1].sampling": true, "log.size": true, "log.age": true}
+	if got := explicitZeros(tree, "", nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("explicitZeros = %v, want %v", got, want)
+	}
+}
+
+// jsonEqual reports whether the two JSON documents are equal
+func jsonEqual(t *testing.T, a, b string) bool {
+	t.Helper()
+	var x, y interface{}
+	if err := json.Unmarshal([]byte(a), &x); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(b), &y); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(x, y)
+}
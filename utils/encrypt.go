@@ -0,0 +1,353 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"ftp-client/model"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+Files are encrypted with an envelope scheme: every file gets a random data key (DEK) that encrypts the content
+with AES-256-GCM. The DEK is then encrypted (wrapped) with the master key read from the key file.
+The encrypted file is self-describing, so it can be decrypted without any other information but the master key:
+
+	magic "FTPCENC1" | key ID length (1 byte) | key ID | wrapped DEK (nonce + ciphertext) | nonce prefix (7 bytes) | segments
+
+The content is split in segments of 64 KiB, each one sealed with the nonce: prefix | segment counter | last segment flag,
+so that large files can be encrypted and decrypted in streaming and truncated files are detected.
+*/
+
+// suffix added to the name of the encrypted files
+const EncryptionSuffix = ".enc"
+
+// metadata stored with the encrypted objects
+const (
+	MetadataEncryption      = "encryption"
+	MetadataEncryptionKeyID = "encryption-key-id"
+)
+
+const (
+	encryptionMagic     = "FTPCENC1"
+	encryptionAlgorithm = "aes-256-gcm"
+	segmentSize         = 64 * 1024
+	noncePrefixSize     = 7
+)
+
+// AnyKeyID can be used as key ID in the keys passed to NewDecryptReader to match any key ID
+const AnyKeyID = "*"
+
+// ErrUnknownKey is returned when a file is encrypted with a key that is not available
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// Encryptor encrypts files with the master key read from the key file
+type Encryptor struct {
+	Key   []byte // master key (32 bytes)
+	KeyID string // ID of the master key, stored in the encrypted files
+}
+
+/*
+NewEncryptor reads the master key from the key file of the given configuration and returns the corresponding Encryptor.
+It returns (nil, nil) if the encryption is not enabled.
+If the key ID is not set in the configuration, it's derived from the key itself.
+*/
+func NewEncryptor(e *model.Encryption) (*Encryptor, error) {
+	if e == nil || e.KeyFile == "" {
+		return nil, nil
+	}
+	key, err := LoadEncryptionKey(e.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	keyID := e.KeyID
+	if keyID == "" {
+		sum := sha256.Sum256(key)
+		keyID = hex.EncodeToString(sum[:8])
+	}
+	if len(keyID) > 255 {
+		return nil, fmt.Errorf("key ID %q too long", keyID)
+	}
+	return &Encryptor{Key: key, KeyID: keyID}, nil
+}
+
+/*
+EffectiveEncryption returns the encryption configuration of the given server: the server's own setting if present,
+otherwise the global one. An empty "key_file" disables the encryption for the server.
+*/
+func EffectiveEncryption(server model.Server, config model.Config) *model.Encryption {
+	if server.Encryption != nil {
+		return server.Encryption
+	}
+	return config.Encryption
+}
+
+/*
+LoadEncryptionKey reads a 256-bit key from the given file.
+The file can contain the raw 32 bytes of the key or its hex/base64 encoding.
+*/
+func LoadEncryptionKey(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %v", err)
+	}
+	if len(b) == 32 {
+		return b, nil
+	}
+	text := strings.TrimSpace(string(b))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key file %s must contain a 256-bit key (raw, hex or base64)", path)
+}
+
+/*
+EncryptFile encrypts the data of the file that will be uploaded to Cloud Storage.
+The ".enc" suffix is added to the object's name and the key ID is stored in the object's metadata.
+Since an encrypted object can't be decompressed by Cloud Storage, a gzip Content-Encoding is replaced by the ".gz" suffix.
+*/
+func (e *Encryptor) EncryptFile(file *FileToUpload) error {
+	if e == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	w, err := e.NewEncryptWriter(&buf)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(file.Data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if file.ContentEncoding == "gzip" {
+		file.ContentEncoding = ""
+		file.Filename += ".gz"
+	}
+	if file.Metadata == nil {
+		file.Metadata = make(map[string]string)
+	}
+	file.Metadata[MetadataEncryption] = encryptionAlgorithm
+	file.Metadata[MetadataEncryptionKeyID] = e.KeyID
+	file.Data = buf.Bytes()
+	file.Filename += EncryptionSuffix
+	return nil
+}
+
+// NewEncryptWriter returns a writer that encrypts the data written to it to w. The writer must be closed to write the last segment.
+func (e *Encryptor) NewEncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	wrapped, err := sealOnce(e.Key, dek, []byte(encryptionMagic+e.KeyID))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	// write the header
+	header := []byte(encryptionMagic)
+	header = append(header, byte(len(e.KeyID)))
+	header = append(header, e.KeyID...)
+	header = append(header, wrapped...)
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, segmentSize)}, nil
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// a full segment is sealed only when more data arrives, so that the last one can be flagged on Close
+		if len(ew.buf) == segmentSize {
+			if err := ew.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(ew.buf[len(ew.buf):segmentSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (ew *encryptWriter) Close() error {
+	return ew.seal(true)
+}
+
+func (ew *encryptWriter) seal(last bool) error {
+	out := ew.aead.Seal(nil, segmentNonce(ew.prefix, ew.counter, last), ew.buf, nil)
+	if _, err := ew.w.Write(out); err != nil {
+		return err
+	}
+	ew.counter++
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+/*
+NewDecryptReader returns a reader that decrypts the data read from r.
+The keys parameter maps a key ID to the corresponding master key: ErrUnknownKey is returned if the file
+was encrypted with a key not in the map (the key mapped to AnyKeyID, if any, is used for all the key IDs).
+The key ID of the file is returned as well.
+*/
+func NewDecryptReader(r io.Reader, keys map[string][]byte) (io.Reader, string, error) {
+	magic := make([]byte, len(encryptionMagic)+1)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, "", fmt.Errorf("not an encrypted file")
+	}
+	keyID := make([]byte, int(magic[len(encryptionMagic)]))
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, "", fmt.Errorf("reading header: %v", err)
+	}
+	key, ok := keys[string(keyID)]
+	if !ok {
+		key, ok = keys[AnyKeyID]
+	}
+	if !ok {
+		return nil, string(keyID), fmt.Errorf("%w %s", ErrUnknownKey, keyID)
+	}
+	wrapped := make([]byte, 12+32+16)
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return nil, string(keyID), fmt.Errorf("reading header: %v", err)
+	}
+	dek, err := openOnce(key, wrapped, []byte(encryptionMagic+string(keyID)))
+	if err != nil {
+		return nil, string(keyID), fmt.Errorf("unwrapping data key: %v", err)
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, string(keyID), err
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, string(keyID), fmt.Errorf("reading header: %v", err)
+	}
+	return &decryptReader{r: r, aead: aead, prefix: prefix, segment: make([]byte, segmentSize+aead.Overhead()+1)}, string(keyID), nil
+}
+
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	segment []byte // read buffer: one sealed segment plus one byte to detect whether it's the last one
+	pending int    // bytes already read in segment (belonging to the next sealed segment)
+	plain   []byte // decrypted data not returned yet
+	done    bool
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+// next reads and decrypts the next segment
+func (dr *decryptReader) next() error {
+	n, err := io.ReadFull(dr.r, dr.segment[dr.pending:])
+	n += dr.pending
+	last := false
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		last = true
+	} else if err != nil {
+		return err
+	}
+	sealedLen := n
+	if !last {
+		sealedLen = n - 1 // the extra byte belongs to the next segment
+	}
+	plain, err := dr.aead.Open(nil, segmentNonce(dr.prefix, dr.counter, last), dr.segment[:sealedLen], nil)
+	if err != nil {
+		return fmt.Errorf("decrypting segment %d: the file is corrupted or truncated", dr.counter)
+	}
+	dr.plain = plain
+	dr.counter++
+	if last {
+		dr.done = true
+	} else {
+		dr.segment[0] = dr.segment[sealedLen]
+		dr.pending = 1
+	}
+	return nil
+}
+
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealOnce encrypts a short message (the data key) with a random nonce, returned before the ciphertext
+func sealOnce(key, plain, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, aad), nil
+}
+
+func openOnce(key, sealed, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
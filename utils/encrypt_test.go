@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func newTestEncryptor(t *testing.T, keyID string) *Encryptor {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return &Encryptor{Key: key, KeyID: keyID}
+}
+
+func encrypt(t *testing.T, e *Encryptor, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := e.NewEncryptWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	e := newTestEncryptor(t, "key-1")
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		sealed := encrypt(t, e, plain)
+		r, keyID, err := NewDecryptReader(bytes.NewReader(sealed), map[string][]byte{"key-1": e.Key})
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if keyID != "key-1" {
+			t.Errorf("size %d: key ID %q, want key-1", size, keyID)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: the data decrypted is different", size)
+		}
+	}
+}
+
+func TestDecryptRejected(t *testing.T) {
+	e := newTestEncryptor(t, "key-1")
+	plain := bytes.Repeat([]byte("x"), 2*segmentSize+100)
+	sealed := encrypt(t, e, plain)
+	other := newTestEncryptor(t, "key-1")
+
+	if _, _, err := NewDecryptReader(bytes.NewReader(sealed), map[string][]byte{"key-2": e.Key}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("unknown key ID: %v, want ErrUnknownKey", err)
+	}
+	if _, _, err := NewDecryptReader(bytes.NewReader(sealed), map[string][]byte{"key-1": other.Key}); err == nil {
+		t.Error("wrong key: the data key was unwrapped")
+	}
+	if _, _, err := NewDecryptReader(bytes.NewReader(sealed), map[string][]byte{AnyKeyID: other.Key}); err == nil {
+		t.Error("wrong key for any key ID: the data key was unwrapped")
+	}
+	if _, _, err := NewDecryptReader(bytes.NewReader(plain), map[string][]byte{"key-1": e.Key}); err == nil {
+		t.Error("a plain file was accepted")
+	}
+
+	// a truncated file is detected, even at the end of a segment
+	header := len(encryptionMagic) + 1 + len("key-1") + 12 + 32 + 16 + noncePrefixSize
+	for _, cut := range []int{len(sealed) - 1, len(sealed) - 20000, header + segmentSize + 16} {
+		r, _, err := NewDecryptReader(bytes.NewReader(sealed[:cut]), map[string][]byte{AnyKeyID: e.Key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(r); err == nil {
+			t.Errorf("file truncated at %d/%d bytes: no error", cut, len(sealed))
+		}
+	}
+}
+
+func TestEncryptFile(t *testing.T) {
+	e := newTestEncryptor(t, "key-1")
+	file := FileToUpload{Data: []byte("data"), Filename: "a__1-1-2026_0-0-0.csv", ContentEncoding: "gzip"}
+	if err := e.EncryptFile(&file); err != nil {
+		t.Fatal(err)
+	}
+	// the object can't be decompressed by Cloud Storage anymore: the compression is in the name
+	if file.Filename != "a__1-1-2026_0-0-0.csv.gz.enc" || file.ContentEncoding != "" {
+		t.Errorf("object %q with Content-Encoding %q, want a__1-1-2026_0-0-0.csv.gz.enc without", file.Filename, file.ContentEncoding)
+	}
+	if file.Metadata[MetadataEncryptionKeyID] != "key-1" {
+		t.Errorf("metadata %v, want the key ID", file.Metadata)
+	}
+	r, _, err := NewDecryptReader(bytes.NewReader(file.Data), map[string][]byte{"key-1": e.Key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "data" {
+		t.Errorf("decrypted %q, want data", got)
+	}
+}
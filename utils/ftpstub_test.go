@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpStub is an FTP server that keeps the files in memory (enough for the client of the tests: no listing)
+type ftpStub struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	files    map[string][]byte
+	commands []string       // commands received after the login, e.g. "RNFR a.csv.part"
+	fail     map[string]int // key: command (e.g. "RNTO"), value: times it fails before succeeding
+}
+
+func newFTPStub(t *testing.T, files map[string]string) *ftpStub {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ftpStub{listener: l, files: make(map[string][]byte), fail: make(map[string]int)}
+	for name, data := range files {
+		s.files[name] = []byte(data)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+// dial returns a client logged in the stub
+func (s *ftpStub) dial(t *testing.T) *ftp.ServerConn {
+	t.Helper()
+	client, err := ftp.Dial(s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Login("u", "p"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Quit() })
+	return client
+}
+
+func (s *ftpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 stub")
+	var data net.Listener // passive data connection
+	var renameFrom string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		s.mu.Lock()
+		if verb != "USER" && verb != "PASS" && verb != "FEAT" && verb != "TYPE" && verb != "EPSV" {
+			s.commands = append(s.commands, strings.TrimSpace(verb+" "+arg))
+		}
+		failed := s.fail[verb] > 0
+		if failed {
+			s.fail[verb]--
+		}
+		_, exists := s.files[arg]
+		s.mu.Unlock()
+		if failed {
+			tp.PrintfLine("550 %s failed", verb)
+			continue
+		}
+		switch verb {
+		case "USER":
+			tp.PrintfLine("331 password required")
+		case "PASS":
+			tp.PrintfLine("230 logged in")
+		case "TYPE":
+			tp.PrintfLine("200 type set")
+		case "EPSV":
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				tp.PrintfLine("425 %v", err)
+				continue
+			}
+			tp.PrintfLine("229 Entering Extended Passive Mode (|||%d|)", data.Addr().(*net.TCPAddr).Port)
+		case "STOR":
+			if data == nil {
+				tp.PrintfLine("425 no data connection")
+				continue
+			}
+			tp.PrintfLine("150 opening data connection")
+			dc, err := data.Accept()
+			data.Close()
+			data = nil
+			if err != nil {
+				tp.PrintfLine("425 %v", err)
+				continue
+			}
+			b, err := io.ReadAll(dc)
+			dc.Close()
+			if err != nil {
+				tp.PrintfLine("426 %v", err)
+				continue
+			}
+			s.mu.Lock()
+			s.files[arg] = b
+			s.mu.Unlock()
+			tp.PrintfLine("226 transfer complete")
+		case "DELE":
+			if !exists {
+				tp.PrintfLine("550 %s not found", arg)
+				continue
+			}
+			s.mu.Lock()
+			delete(s.files, arg)
+			s.mu.Unlock()
+			tp.PrintfLine("250 deleted")
+		case "RNFR":
+			if !exists {
+				tp.PrintfLine("550 %s not found", arg)
+				continue
+			}
+			renameFrom = arg
+			tp.PrintfLine("350 ready for RNTO")
+		case "RNTO":
+			s.mu.Lock()
+			s.files[arg] = s.files[renameFrom]
+			delete(s.files, renameFrom)
+			s.mu.Unlock()
+			tp.PrintfLine("250 renamed")
+		case "MKD":
+			tp.PrintfLine("257 %q created", arg)
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default: // FEAT and the others
+			tp.PrintfLine("502 %s not implemented", verb)
+		}
+	}
+}
+
+// file returns the content of the file and whether it exists
+func (s *ftpStub) file(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.files[name]
+	return string(b), ok
+}
+
+// received returns the commands received after the login
+func (s *ftpStub) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
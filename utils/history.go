@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"ftp-client/model"
+	"ftp-client/state"
+	"sort"
+	"time"
+)
+
+// delivery status of a version of a file
+const (
+	VersionDetected  = "detected"  // found on the FTP server, not delivered yet
+	VersionDelivered = "delivered" // delivered to (at least) one destination
+	VersionFailed    = "failed"    // the last delivery attempt failed
+	VersionConflict  = "conflict"  // the object already exists in the bucket with a different content
+)
+
+// max number of versions kept in the history of a file if "history_limit" is not set
+const defaultHistoryLimit = 20
+
+/*
+RecordDelivery updates the history of the file with the outcome of the delivery of the given version:
+the hash of the file and the destination (object URL or local path) are recorded if the delivery succeeded,
+the error otherwise. Only a confirmed delivery advances the delivered version of the file: the versions not
+delivered are transferred again in the next cycles.
+*/
+func RecordDelivery(store state.Store, serverName, name string, timestamp uint64, hash, destination string, err error) error {
+	updateErr := store.Update(serverName, name, func(info *model.FileInfo, ok bool) error {
+		if !ok {
+			return state.ErrNotTracked
+		}
+		// look for the version from the newest, since it's usually the last one
+		for i := len(info.Versions) - 1; i >= 0; i-- {
+			v := &info.Versions[i]
+			if v.Timestamp != timestamp {
+				continue
+			}
+			if hash != "" {
+				v.Hash = hash
+			}
+			switch {
+			case err == nil:
+				v.Status = VersionDelivered
+				v.Error = ""
+				v.Destinations = appendUnique(v.Destinations, destination)
+			case isConflict(err):
+				v.Status = VersionConflict
+				v.Error = err.Error()
+			default:
+				if v.Status != VersionDelivered {
+					v.Status = VersionFailed
+				}
+				v.Error = err.Error()
+			}
+			break
+		}
+		// a conflict is final as well: the version will never be accepted by the bucket, so it's not retried
+		if (err == nil || isConflict(err)) && timestamp > info.Delivered {
+			info.Delivered = timestamp
+		}
+		return nil
+	})
+	if updateErr == state.ErrNotTracked {
+		return nil
+	}
+	return updateErr
+}
+
+// Failure is the latest version of a file whose delivery failed (or conflicted with the object in the bucket)
+type Failure struct {
+	Server  string        `json:"server"`
+	File    string        `json:"file"`
+	Version model.Version `json:"version"`
+}
+
+// FailedDeliveries returns the files of the server whose latest version was not delivered because of an error
+func FailedDeliveries(store state.Store, source string) ([]Failure, error) {
+	files, err := store.Files(source)
+	if err != nil {
+		return nil, err
+	}
+	var failures []Failure
+	for name, info := range files {
+		if info.Deleted != 0 || len(info.Versions) == 0 {
+			continue
+		}
+		if v := info.Versions[len(info.Versions)-1]; v.Status == VersionFailed || v.Status == VersionConflict {
+			failures = append(failures, Failure{Server: source, File: name, Version: v})
+		}
+	}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].File < failures[j].File })
+	return failures, nil
+}
+
+// FilesSeenSince returns how many files of the server had a new version found after the given time (e.g. today)
+func FilesSeenSince(store state.Store, source string, since time.Time) (int, error) {
+	files, err := store.Files(source)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, info := range files {
+		if k := len(info.Versions); k > 0 && !info.Versions[k-1].DetectedAt.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+/*
+ResetDelivery marks the latest version of the file as not delivered, so that it's transferred again in the next
+cycle of the server (e.g. to download again a file whose copy was lost, or to retry a conflict once the object in the
+bucket has been fixed). The delivered version goes back to the newest older version that was delivered.
+*/
+func ResetDelivery(store state.Store, source, name string) error {
+	return store.Update(source, name, func(info *model.FileInfo, ok bool) error {
+		if !ok {
+			return state.ErrNotTracked
+		}
+		if info.Deleted != 0 {
+			return fmt.Errorf("%s was deleted from the server", name)
+		}
+		info.Delivered = 0
+		for _, v := range info.Versions {
+			if v.Status == VersionDelivered && v.Timestamp < info.Timestamp && v.Timestamp > info.Delivered {
+				info.Delivered = v.Timestamp
+			}
+		}
+		return nil
+	})
+}
+
+func appendUnique(list []string, s string) []string {
+	if s == "" {
+		return list
+	}
+	for _, item := range list {
+		if item == s {
+			return list
+		}
+	}
+	// a new slice is returned, since the list may be shared with a copy of the file's info
+	return append(list[:len(list):len(list)], s)
+}
+
+func isConflict(err error) bool {
+	return errors.Is(err, ErrObjectConflict)
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+InFlightFiles collects the versions of the files of an FTP server sent to the uploader and not confirmed yet.
+Those versions are not delivered yet, but they must not be transferred again while their upload is in progress.
+The files are added by the server's goroutine and confirmed by the uploader goroutine, so the access is protected by a mutex.
+Since they're kept in memory, after a restart the versions not confirmed are transferred again (at-least-once delivery).
+*/
+type InFlightFiles struct {
+	mu    sync.Mutex
+	files map[string]uint64 // key: filename, value: timestamp of the version sent
+	done  *sync.Cond        // signaled when a delivery ends
+}
+
+// NewInFlightFiles returns an empty InFlightFiles
+func NewInFlightFiles() *InFlightFiles {
+	p := &InFlightFiles{files: make(map[string]uint64)}
+	p.done = sync.NewCond(&p.mu)
+	return p
+}
+
+// Add records that the given version of the file was sent to the uploader
+func (p *InFlightFiles) Add(name string, timestamp uint64) {
+	p.mu.Lock()
+	p.files[name] = timestamp
+	p.mu.Unlock()
+}
+
+// Done records that the delivery of the given version ended (successfully or not)
+func (p *InFlightFiles) Done(name string, timestamp uint64) {
+	p.mu.Lock()
+	if p.files[name] == timestamp {
+		delete(p.files, name)
+	}
+	p.mu.Unlock()
+	p.done.Broadcast()
+}
+
+/*
+Wait blocks until the deliveries of all the files added are ended, or until the context is done.
+It reports whether the deliveries ended.
+*/
+func (p *InFlightFiles) Wait(ctx context.Context) bool {
+	stop := context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		p.done.Broadcast()
+		p.mu.Unlock()
+	})
+	defer stop()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.files) > 0 {
+		if ctx.Err() != nil {
+			return false
+		}
+		p.done.Wait()
+	}
+	return true
+}
+
+// Has reports whether the given version of the file is being delivered
+func (p *InFlightFiles) Has(name string, timestamp uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ts, ok := p.files[name]
+	return ok && ts == timestamp
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestInFlightWait(t *testing.T) {
+	p := NewInFlightFiles()
+	p.Add("a.csv", 1)
+	p.Add("b.csv", 2)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		p.Done("a.csv", 1)
+		p.Done("b.csv", 1) // another version: b.csv is still in flight
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if p.Wait(ctx) {
+		t.Fatal("Wait = true, want false (b.csv is still in flight)")
+	}
+	if !p.Has("b.csv", 2) || p.Has("a.csv", 1) {
+		t.Error("the versions in flight are wrong")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		p.Done("b.csv", 2)
+	}()
+	if !p.Wait(context.Background()) {
+		t.Error("Wait = false, want true")
+	}
+}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"ftp-client/model"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// formats of the log records
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+/*
+The level and the format are the same for all the loggers: they're set by the configuration when the loggers are
+created and when the log settings are reloaded (see ApplyLogConfig).
+*/
+var (
+	logLevel = new(slog.LevelVar) // info by default
+	logJSON  atomic.Bool
+)
+
+var (
+	consoleMu sync.Mutex
+	console   io.Writer = os.Stdout // where the loggers write the records, besides the log files
+)
+
+/*
+SetLogConsole sets where the loggers created from now on write the records, besides the log files: stdout by
+default. The once command sets stderr, so that stdout is left to its summary.
+*/
+func SetLogConsole(w io.Writer) {
+	consoleMu.Lock()
+	defer consoleMu.Unlock()
+	console = w
+}
+
+func logConsole() io.Writer {
+	consoleMu.Lock()
+	defer consoleMu.Unlock()
+	return console
+}
+
+// ParseLogLevel parses the level of the log configuration: debug, info (the default), warn or error
+func ParseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("invalid level %q (expected debug, info, warn or error)", s)
+	}
+	return level, nil
+}
+
+// setLogOptions sets the level and the format of all the loggers
+func setLogOptions(l model.Log) {
+	if level, err := ParseLogLevel(l.Level); err == nil {
+		logLevel.Set(level)
+	}
+	logJSON.Store(l.Format == LogFormatJSON)
+}
+
+/*
+newLogHandler returns the handler that writes the records to each of the writers (e.g. stdout and the log file),
+as text or JSON according to the format in use.
+*/
+func newLogHandler(writers ...io.Writer) slog.Handler {
+	h := make(teeHandler, len(writers))
+	for i, w := range writers {
+		opts := &slog.HandlerOptions{Level: logLevel}
+		h[i] = &formatHandler{text: slog.NewTextHandler(w, opts), json: slog.NewJSONHandler(w, opts)}
+	}
+	return h
+}
+
+// formatHandler writes the records with the text or the JSON handler, according to the format in use
+type formatHandler struct {
+	text, json slog.Handler
+}
+
+func (h *formatHandler) current() slog.Handler {
+	if logJSON.Load() {
+		return h.json
+	}
+	return h.text
+}
+
+func (h *formatHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.current().Enabled(ctx, level)
+}
+
+func (h *formatHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.current().Handle(ctx, r)
+}
+
+func (h *formatHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &formatHandler{text: h.text.WithAttrs(attrs), json: h.json.WithAttrs(attrs)}
+}
+
+func (h *formatHandler) WithGroup(name string) slog.Handler {
+	return &formatHandler{text: h.text.WithGroup(name), json: h.json.WithGroup(name)}
+}
+
+// teeHandler sends the records to all its handlers
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var first error
+	for _, h := range t {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+// ServerLogger returns the logger of the server: its records have the server's ID and host
+func ServerLogger(config model.Config, conf model.Server) *slog.Logger {
+	id := SourceID(conf)
+	return InitLogger(config, id).With("server", id, "host", conf.Host)
+}
@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"ftp-client/events"
+	"ftp-client/model"
+	"ftp-client/state"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/jlaffaye/ftp"
+)
+
+// actions run (in mirror mode) on the copies of a file deleted from the FTP server
+const (
+	MirrorKeep   = "keep"
+	MirrorDelete = "delete"
+	MirrorMove   = "move"
+)
+
+// consecutive listings a file must be missing from before it's considered deleted, if "missing_listings" is not set
+const defaultMissingListings = 3
+
+/*
+MirrorDeletions propagates the deletion of the files from the FTP server (mirror mode).
+The files tracked in the state store but missing from the listing passed as parameter get their "missing" counter
+increased: once a file has been missing for "missing_listings" consecutive listings, a tombstone is recorded for it,
+the action configured is run on its local copy and on its object in the bucket and a FileDeleted event is emitted.
+The files removed by the post-transfer action are not considered deleted.
+It must be called only with the result of a successful listing.
+*/
+func MirrorDeletions(conf model.Server, files []*ftp.Entry, store state.Store, cs *ClientCloudStorage, compression *model.Compression, encrypted bool, logger *slog.Logger) {
+	mirror := conf.Mirror
+	if mirror == nil {
+		return
+	}
+	threshold := mirror.MissingListings
+	if threshold <= 0 {
+		threshold = defaultMissingListings
+	}
+	listed := make(map[string]bool, len(files))
+	for _, f := range files {
+		if f.Type.String() == "file" {
+			listed[f.Name] = true
+		}
+	}
+
+	source := SourceID(conf)
+	tracked, err := store.Files(source)
+	if err != nil {
+		logger.Error("Error reading the state", "error", err)
+		return
+	}
+	deleted := make(map[string]model.FileInfo)
+	for name, info := range tracked {
+		if info.Deleted != 0 || info.Archived || !matchExtension(name, conf.FileExtension) {
+			continue
+		}
+		if listed[name] && info.Missing == 0 {
+			continue
+		}
+		err := store.Update(source, name, func(i *model.FileInfo, ok bool) error {
+			if listed[name] {
+				i.Missing = 0
+				return nil
+			}
+			i.Missing++
+			if i.Missing >= threshold {
+				i.Deleted = time.Now().Unix()
+				deleted[name] = *i
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Error("Error updating the state", "file", name, "error", err)
+			delete(deleted, name)
+		}
+	}
+
+	for name, info := range deleted {
+		logger.Info("File deleted from the server, tombstone recorded", "file", name, "missing_listings", info.Missing)
+
+		// the names of the copies are built as the ones of the latest version delivered
+		base := DeliveredFilename(name, info.Timestamp)
+		localPath := filepath.Join(LocalDir(source), LocalFilename(base, compression, encrypted))
+		event := events.Event{Type: events.FileDeleted, Server: source, Host: conf.Host, File: name, Local: localPath}
+		if err := mirrorLocalFile(mirror, localPath); err != nil {
+			logger.Error("Error removing local copy", "file", name, "error", err)
+			event.Error = err.Error()
+		}
+		if cs != nil {
+			object := fmt.Sprintf("%s/%s/%s", cs.UploadPath, source, ObjectFilename(base, compression, encrypted))
+			event.Object = object
+			if err := mirrorObject(cs, mirror, object); err != nil {
+				logger.Error("Error removing object", "file", name, "object", object, "error", err)
+				event.Error = err.Error()
+			}
+		}
+		events.Emit(event)
+	}
+}
+
+// mirrorLocalFile runs the mirror action on the local copy of a deleted file (if it exists)
+func mirrorLocalFile(mirror *model.Mirror, localPath string) error {
+	if _, err := os.Stat(localPath); err != nil {
+		return nil // no local copy
+	}
+	switch mirror.Local {
+	case MirrorDelete:
+		return os.Remove(localPath)
+	case MirrorMove:
+		if err := os.MkdirAll(mirror.LocalArchiveDir, 0750); err != nil {
+			return err
+		}
+		return os.Rename(localPath, filepath.Join(mirror.LocalArchiveDir, filepath.Base(localPath)))
+	}
+	return nil
+}
+
+// mirrorObject runs the mirror action on the object of a deleted file (if it exists)
+func mirrorObject(cs *ClientCloudStorage, mirror *model.Mirror, object string) error {
+	if mirror.Bucket != MirrorDelete && mirror.Bucket != MirrorMove {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	src := cs.Client.Bucket(cs.BucketName).Object(object)
+	if mirror.Bucket == MirrorMove {
+		dst := cs.Client.Bucket(cs.BucketName).Object(path.Join(mirror.BucketArchivePrefix, object))
+		if _, err := dst.CopierFrom(src).Run(ctx); err != nil {
+			if err == storage.ErrObjectNotExist {
+				return nil
+			}
+			return err
+		}
+	}
+	if err := src.Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	return nil
+}
+
+/*
+MarkArchived records that the files were removed from the server by the post-transfer action,
+so that their removal is not propagated in mirror mode.
+*/
+func MarkArchived(store state.Store, serverName string, names []string) error {
+	for _, name := range names {
+		err := store.Update(serverName, name, func(info *model.FileInfo, ok bool) error {
+			if !ok {
+				return state.ErrNotTracked
+			}
+			info.Archived = true
+			return nil
+		})
+		if err != nil && err != state.ErrNotTracked {
+			return err
+		}
+	}
+	return nil
+}
+
+// ObjectFilename returns the name of the object of a file delivered with the given compression and encryption (see CompressFile and EncryptFile)
+func ObjectFilename(base string, c *model.Compression, encrypted bool) string {
+	if c != nil && c.Algorithm == CompressionGzip && !encrypted {
+		return base // stored with "Content-Encoding: gzip"
+	}
+	return LocalFilename(base, c, encrypted)
+}
+
+// LocalFilename returns the name of the local copy of a file saved with the given compression and encryption (see SaveFileLocally)
+func LocalFilename(base string, c *model.Compression, encrypted bool) string {
+	name := base + CompressionSuffix(c)
+	if encrypted {
+		name += EncryptionSuffix
+	}
+	return name
+}
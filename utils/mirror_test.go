@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"ftp-client/model"
+	"ftp-client/state"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+func TestMirrorDeletionsThreshold(t *testing.T) {
+	dataDir := DataDir
+	DataDir = t.TempDir()
+	defer func() { DataDir = dataDir }()
+	store, err := state.OpenJSON(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := model.Server{ID: "line3", FileExtension: "csv", Mirror: &model.Mirror{MissingListings: 2, Local: MirrorDelete}}
+	modified := time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+	for _, name := range []string{"a.csv", "b.csv", "c.txt"} {
+		store.Put("line3", name, model.FileInfo{Timestamp: uint64(modified.Unix()), Delivered: uint64(modified.Unix())})
+	}
+	store.Put("line3", "archived.csv", model.FileInfo{Timestamp: uint64(modified.Unix()), Archived: true})
+	local := filepath.Join(LocalDir("line3"), DeliveredFilename("a.csv", uint64(modified.Unix())))
+	os.MkdirAll(LocalDir("line3"), 0750)
+	if err := os.WriteFile(local, []byte("a"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := func(name string) *ftp.Entry { return &ftp.Entry{Name: name, Type: ftp.EntryTypeFile, Time: modified} }
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	listings := []struct {
+		files   []*ftp.Entry
+		missing int  // "missing" counter of a.csv after the listing
+		deleted bool // a.csv has a tombstone
+	}{
+		{[]*ftp.Entry{entry("b.csv")}, 1, false},
+		{[]*ftp.Entry{entry("a.csv"), entry("b.csv")}, 0, false}, // the counter is reset: the listings must be consecutive
+		{[]*ftp.Entry{entry("b.csv")}, 1, false},
+		{[]*ftp.Entry{entry("b.csv")}, 2, true},
+		{[]*ftp.Entry{entry("b.csv")}, 2, true}, // the tombstone is recorded once
+	}
+	for i, l := range listings {
+		MirrorDeletions(conf, l.files, store, nil, nil, false, logger)
+		info, _, _ := store.Get("line3", "a.csv")
+		if info.Missing != l.missing || (info.Deleted != 0) != l.deleted {
+			t.Fatalf("listing %d: missing %d, deleted %v, want %d, %v", i+1, info.Missing, info.Deleted != 0, l.missing, l.deleted)
+		}
+		if _, err := os.Stat(local); os.IsNotExist(err) != l.deleted {
+			t.Fatalf("listing %d: local copy removed %v, want %v", i+1, os.IsNotExist(err), l.deleted)
+		}
+	}
+	// the files with another extension and the archived ones are not tracked for the deletions
+	for _, name := range []string{"c.txt", "archived.csv"} {
+		if info, _, _ := store.Get("line3", name); info.Missing != 0 || info.Deleted != 0 {
+			t.Errorf("%s: missing %d, deleted %d, want neither", name, info.Missing, info.Deleted)
+		}
+	}
+	if info, _, _ := store.Get("line3", "b.csv"); info.Missing != 0 || info.Deleted != 0 {
+		t.Errorf("b.csv (listed): missing %d, deleted %d", info.Missing, info.Deleted)
+	}
+}
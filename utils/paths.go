@@ -0,0 +1,31 @@
+package utils
+
+import "path/filepath"
+
+/*
+Directories used by the connector, relative to the working directory unless absolute paths are set.
+They can be changed with the global flags of the command line, so that more instances can run side by side.
+*/
+var (
+	LogDir   = "log"   // log files (<name>.log)
+	DataDir  = "files" // files saved locally (<data dir>/<source ID>/)
+	StateDir = ""      // state store (see state.Open); if empty, the log directory is used (where log.json was saved)
+)
+
+// LogFile returns the path of the log file with the given name
+func LogFile(name string) string {
+	return filepath.Join(LogDir, name+".log")
+}
+
+// LocalDir returns the directory where the files of the server are saved locally
+func LocalDir(source string) string {
+	return filepath.Join(DataDir, source)
+}
+
+// StateDirectory returns the directory of the state store
+func StateDirectory() string {
+	if StateDir == "" {
+		return LogDir
+	}
+	return StateDir
+}
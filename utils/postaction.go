@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"fmt"
+	"ftp-client/model"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// actions that can be run on the FTP server once a file has been delivered
+const (
+	PostActionDelete = "delete"
+	PostActionMove   = "move"
+	PostActionRename = "rename"
+)
+
+// max number of post-transfer actions run in a single cycle if "max_per_cycle" is not set
+const defaultMaxPostActions = 10
+
+/*
+DeliveredFiles collects the files of an FTP server whose delivery was confirmed by the sinks
+(Cloud Storage or the local folder) and that are waiting for the post-transfer action.
+The files are confirmed by the uploader goroutine and consumed by the server's goroutine, so the access is protected by a mutex.
+*/
+type DeliveredFiles struct {
+	mu    sync.Mutex
+	files map[string]uint64 // key: filename, value: timestamp of the version delivered
+}
+
+// NewDeliveredFiles returns an empty DeliveredFiles
+func NewDeliveredFiles() *DeliveredFiles {
+	return &DeliveredFiles{files: make(map[string]uint64)}
+}
+
+// Add records that the given version of the file was delivered
+func (d *DeliveredFiles) Add(name string, timestamp uint64) {
+	d.mu.Lock()
+	d.files[name] = timestamp
+	d.mu.Unlock()
+}
+
+// remove forgets the file, unless a newer version was delivered in the meantime
+func (d *DeliveredFiles) remove(name string, timestamp uint64) {
+	d.mu.Lock()
+	if d.files[name] == timestamp {
+		delete(d.files, name)
+	}
+	d.mu.Unlock()
+}
+
+// snapshot returns a copy of the files delivered
+func (d *DeliveredFiles) snapshot() map[string]uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	files := make(map[string]uint64, len(d.files))
+	for name, timestamp := range d.files {
+		files[name] = timestamp
+	}
+	return files
+}
+
+/*
+RunPostActions runs the post-transfer action configured for the server (delete, move or rename) on the files delivered.
+The files listed in the last listing of the server's directory are passed as parameter: the action is run only if
+the file is still on the server with the same version that was delivered (a newer version will be transferred and
+confirmed again). At most "max_per_cycle" actions are run per call: the other files are left for the next cycle.
+In dry-run mode the actions are only logged.
+It returns the names of the files removed from the server.
+*/
+func RunPostActions(client *ftp.ServerConn, conf model.Server, files []*ftp.Entry, delivered *DeliveredFiles, logger *slog.Logger) []string {
+	action := conf.PostAction
+	if action == nil || action.Action == "" {
+		return nil
+	}
+	pending := delivered.snapshot()
+	if len(pending) == 0 {
+		return nil
+	}
+	listed := make(map[string]*ftp.Entry, len(files))
+	for _, f := range files {
+		listed[f.Name] = f
+	}
+	names := make([]string, 0, len(pending))
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// the files still on the server with the version delivered
+	due := make([]string, 0, len(names))
+	for _, name := range names {
+		f, ok := listed[name]
+		if !ok || uint64(f.Time.Unix()) != pending[name] {
+			// the file was removed or changed after the delivery: nothing to do for this version
+			delivered.remove(name, pending[name])
+			continue
+		}
+		due = append(due, name)
+	}
+
+	limit := action.MaxPerCycle
+	if limit <= 0 {
+		limit = defaultMaxPostActions
+	}
+	if len(due) > limit {
+		logger.Info("Post-transfer action limit reached", "limit", limit, "left", len(due)-limit)
+		due = due[:limit]
+	}
+
+	var removed []string
+	for _, name := range due {
+		timestamp := pending[name]
+		if action.DryRun {
+			logger.Info("[DRY-RUN] "+describePostAction(action, name), "file", name)
+			delivered.remove(name, timestamp)
+			continue
+		}
+		if err := runPostAction(client, action, name); err != nil {
+			// the file stays in the delivered ones: the action will be retried in the next cycle
+			logger.Error("Error running post-transfer action", "file", name, "error", err)
+			continue
+		}
+		logger.Info(describePostAction(action, name), "file", name)
+		delivered.remove(name, timestamp)
+		removed = append(removed, name)
+	}
+	return removed
+}
+
+// runPostAction runs the action on the given file
+func runPostAction(client *ftp.ServerConn, action *model.PostAction, name string) error {
+	switch action.Action {
+	case PostActionDelete:
+		return client.Delete(name)
+	case PostActionMove:
+		// create the archive directory if missing (the error is ignored since it fails if the directory already exists)
+		client.MakeDir(action.ArchiveDir)
+		return client.Rename(name, path.Join(action.ArchiveDir, name))
+	case PostActionRename:
+		return client.Rename(name, name+action.Suffix)
+	}
+	return fmt.Errorf("unknown post-transfer action %q", action.Action)
+}
+
+// describePostAction returns the description of the action run on the given file (used for logging)
+func describePostAction(action *model.PostAction, name string) string {
+	switch action.Action {
+	case PostActionDelete:
+		return fmt.Sprintf("Deleted %s", name)
+	case PostActionMove:
+		return fmt.Sprintf("Moved %s to %s", name, path.Join(action.ArchiveDir, name))
+	case PostActionRename:
+		return fmt.Sprintf("Renamed %s to %s", name, name+action.Suffix)
+	}
+	return fmt.Sprintf("Unknown action %s on %s", action.Action, name)
+}
+
+/*
+IsPostActionResult reports whether the file is the result of a rename post-transfer action (i.e. it has the rename suffix):
+such files must not be tracked again.
+*/
+func IsPostActionResult(conf model.Server, name string) bool {
+	action := conf.PostAction
+	return action != nil && action.Action == PostActionRename && action.Suffix != "" && strings.HasSuffix(name, action.Suffix)
+}
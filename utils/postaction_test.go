@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"bytes"
+	"ftp-client/model"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// deliveredFiles returns the listing of the files and the files delivered, with the same versions
+func deliveredFiles(names ...string) ([]*ftp.Entry, *DeliveredFiles) {
+	modified := time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+	delivered := NewDeliveredFiles()
+	var listing []*ftp.Entry
+	for _, name := range names {
+		listing = append(listing, &ftp.Entry{Name: name, Time: modified})
+		delivered.Add(name, uint64(modified.Unix()))
+	}
+	return listing, delivered
+}
+
+func TestRunPostActionsMaxPerCycle(t *testing.T) {
+	stub := newFTPStub(t, map[string]string{"a.csv": "a", "b.csv": "b", "c.csv": "c", "d.csv": "d"})
+	client := stub.dial(t)
+	listing, delivered := deliveredFiles("a.csv", "b.csv", "c.csv", "d.csv")
+	delivered.Add("gone.csv", 1)                      // not on the server anymore
+	delivered.Add("b.csv", uint64(time.Now().Unix())) // changed after the delivery
+	conf := model.Server{PostAction: &model.PostAction{Action: PostActionDelete, MaxPerCycle: 2}}
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	if got := RunPostActions(client, conf, listing, delivered, logger); !reflect.DeepEqual(got, []string{"a.csv", "c.csv"}) {
+		t.Errorf("removed %v, want [a.csv c.csv]", got)
+	}
+	// only d.csv is left for the next cycle: gone.csv and b.csv have nothing to do
+	if !strings.Contains(logs.String(), "left=1") {
+		t.Errorf("the files left are not logged:\n%s", logs.String())
+	}
+	if got := delivered.snapshot(); len(got) != 1 || got["d.csv"] == 0 {
+		t.Errorf("files still delivered %v, want d.csv", got)
+	}
+	for name, want := range map[string]bool{"a.csv": false, "b.csv": true, "c.csv": false, "d.csv": true} {
+		if _, ok := stub.file(name); ok != want {
+			t.Errorf("%s on the server: %v, want %v", name, ok, want)
+		}
+	}
+
+	if got := RunPostActions(client, conf, listing, delivered, logger); !reflect.DeepEqual(got, []string{"d.csv"}) {
+		t.Errorf("second cycle: removed %v, want [d.csv]", got)
+	}
+}
+
+func TestRunPostActionsDryRun(t *testing.T) {
+	stub := newFTPStub(t, map[string]string{"a.csv": "a", "b.csv": "b", "c.csv": "c"})
+	client := stub.dial(t)
+	listing, delivered := deliveredFiles("a.csv", "b.csv", "c.csv")
+	conf := model.Server{PostAction: &model.PostAction{Action: PostActionMove, ArchiveDir: "archive", MaxPerCycle: 2, DryRun: true}}
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	if got := RunPostActions(client, conf, listing, delivered, logger); got != nil {
+		t.Errorf("removed %v in dry-run mode", got)
+	}
+	if got := stub.received(); len(got) != 0 {
+		t.Errorf("commands sent in dry-run mode: %v", got)
+	}
+	for _, want := range []string{"[DRY-RUN] Moved a.csv to archive/a.csv", "[DRY-RUN] Moved b.csv to archive/b.csv", "left=1"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("%q not logged:\n%s", want, logs.String())
+		}
+	}
+	// the limit applies in dry-run mode too: c.csv is logged in the next cycle
+	if got := delivered.snapshot(); len(got) != 1 || got["c.csv"] == 0 {
+		t.Errorf("files still delivered %v, want c.csv", got)
+	}
+}
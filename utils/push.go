@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"ftp-client/model"
+	"ftp-client/state"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/jlaffaye/ftp"
+	"google.golang.org/api/iterator"
+)
+
+// transfer directions of an FTP server
+const (
+	DirectionPull = "pull" // download the files from the server (default)
+	DirectionPush = "push" // upload the files to the server
+	DirectionBoth = "both"
+)
+
+// suffix of the temporary file used while a file is pushed to the FTP server
+const pushTempSuffix = ".part"
+
+// PullEnabled reports whether the files of the server must be downloaded
+func PullEnabled(conf model.Server) bool {
+	return conf.Direction == "" || conf.Direction == DirectionPull || conf.Direction == DirectionBoth
+}
+
+// PushEnabled reports whether the files must be uploaded to the server
+func PushEnabled(conf model.Server) bool {
+	return conf.Push != nil && (conf.Direction == DirectionPush || conf.Direction == DirectionBoth)
+}
+
+/*
+PushStateKey returns the source of the state store where the files pushed to the server are tracked
+(key: filename, value: timestamp of the version pushed), next to the files downloaded from it.
+*/
+func PushStateKey(source string) string {
+	return source + "@push"
+}
+
+/*
+IsPushedFile reports whether the file on the FTP server was pushed by the connector (or it's a temporary file of a push in progress):
+those files must not be downloaded again.
+*/
+func IsPushedFile(store state.Store, conf model.Server, name string) bool {
+	if !PushEnabled(conf) {
+		return false
+	}
+	if strings.HasSuffix(name, pushTempSuffix) {
+		return true
+	}
+	// if the state can't be read the file is considered pushed: better skip a download than download a file pushed
+	_, ok, err := store.Get(PushStateKey(SourceID(conf)), name)
+	return ok || err != nil
+}
+
+// pushSource is a file that can be pushed to the FTP server
+type pushSource struct {
+	Name string
+	Time uint64 // last modification time
+	Open func() (io.ReadCloser, error)
+}
+
+/*
+PushFiles uploads to the server's directory the files of the push source (a local directory or a prefix in the bucket)
+that are new or changed since the last time they were pushed. The same state-tracking approach of the downloaded
+files is used: the timestamp of the version pushed is saved in the state store (see PushStateKey).
+Each file is uploaded to a temporary name and then renamed, so that the server never sees a partial file.
+*/
+func PushFiles(client *ftp.ServerConn, conf model.Server, cs *ClientCloudStorage, store state.Store, logger *slog.Logger) {
+	sources, err := listPushSources(conf, cs)
+	if err != nil {
+		logger.Error("Error listing files to push", "error", err)
+		return
+	}
+
+	key := PushStateKey(SourceID(conf))
+	for _, src := range sources {
+		pushed, ok, err := store.Get(key, src.Name)
+		if err != nil {
+			logger.Error("Error reading the state", "file", src.Name, "error", err)
+			continue
+		}
+		if ok && src.Time <= pushed.Timestamp {
+			continue // the server already has this version
+		}
+
+		logger.Debug("Pushing file", "file", src.Name)
+		start := time.Now()
+		if err := pushFile(client, src); err != nil {
+			logger.Error("Error pushing file", "file", src.Name, "error", err)
+			continue
+		}
+		if err := store.Put(key, src.Name, model.FileInfo{Timestamp: src.Time, Delivered: src.Time}); err != nil {
+			// the file will be pushed again in the next cycle
+			logger.Error("Error saving the state", "file", src.Name, "error", err)
+			continue
+		}
+		logger.Info("File successfully pushed", "file", src.Name, "duration", time.Since(start))
+	}
+}
+
+// pushFile uploads the file to a temporary name and then renames it to its final name
+func pushFile(client *ftp.ServerConn, src pushSource) error {
+	reader, err := src.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tmp := src.Name + pushTempSuffix
+	if err := client.Stor(tmp, reader); err != nil {
+		client.Delete(tmp)
+		return fmt.Errorf("Stor: %v", err)
+	}
+	if err := client.Rename(tmp, src.Name); err != nil {
+		// some servers don't overwrite an existing file on rename
+		client.Delete(src.Name)
+		if err := client.Rename(tmp, src.Name); err != nil {
+			// the previous version was deleted: the temporary file is kept, it's the only copy on the server
+			return fmt.Errorf("Rename: %v (the file is left as %s)", err, tmp)
+		}
+	}
+	return nil
+}
+
+// listPushSources lists the files of the server's push source matching the push "file_ext"
+func listPushSources(conf model.Server, cs *ClientCloudStorage) ([]pushSource, error) {
+	var sources []pushSource
+	if conf.Push.LocalDir != "" {
+		entries, err := os.ReadDir(conf.Push.LocalDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() || !matchExtension(e.Name(), conf.Push.FileExtension) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+			filePath := filepath.Join(conf.Push.LocalDir, e.Name())
+			sources = append(sources, pushSource{
+				Name: e.Name(),
+				Time: uint64(info.ModTime().Unix()),
+				Open: func() (io.ReadCloser, error) { return os.Open(filePath) },
+			})
+		}
+	}
+
+	if conf.Push.BucketPrefix != "" {
+		if cs == nil {
+			return sources, fmt.Errorf("cloud storage client not available")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		prefix := strings.TrimSuffix(conf.Push.BucketPrefix, "/") + "/"
+		bucket := cs.Client.Bucket(cs.BucketName)
+		it := bucket.Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: "/"})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return sources, err
+			}
+			name := path.Base(attrs.Name)
+			if attrs.Name == prefix || !matchExtension(name, conf.Push.FileExtension) {
+				continue // skip the "directories" and the files with a different extension
+			}
+			objectName, timeout := attrs.Name, cs.uploadTimeout(int(attrs.Size))
+			sources = append(sources, pushSource{
+				Name: name,
+				Time: uint64(attrs.Updated.Unix()),
+				Open: func() (io.ReadCloser, error) {
+					// the download is bounded like an upload of the same size, the reader is canceled once closed
+					ctx, cancel := context.WithTimeout(context.Background(), timeout)
+					r, err := bucket.Object(objectName).NewReader(ctx)
+					if err != nil {
+						cancel()
+						return nil, err
+					}
+					return cancelReader{r, cancel}, nil
+				},
+			})
+		}
+	}
+	return sources, nil
+}
+
+// cancelReader is a reader whose context is canceled when it's closed
+type cancelReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r cancelReader) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// matchExtension checks if the file has the given extension ("*" or empty match all the files)
+func matchExtension(name, ext string) bool {
+	if ext == "" || ext == "*" {
+		return true
+	}
+	data := strings.Split(name, ".")
+	return data[len(data)-1] == ext
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPushFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		failRenames int // RNTO commands that fail (e.g. a server that doesn't overwrite the existing file)
+		commands    []string
+		files       map[string]string // files on the server after the push
+		wantErr     bool
+	}{
+		{"new version", 0, []string{"STOR a.csv.part", "RNFR a.csv.part", "RNTO a.csv"},
+			map[string]string{"a.csv": "new"}, false},
+		{"no overwrite on rename", 1, []string{"STOR a.csv.part", "RNFR a.csv.part", "RNTO a.csv", "DELE a.csv", "RNFR a.csv.part", "RNTO a.csv"},
+			map[string]string{"a.csv": "new"}, false},
+		// the previous version was deleted: the temporary file is the only copy left
+		{"rename failed", 2, []string{"STOR a.csv.part", "RNFR a.csv.part", "RNTO a.csv", "DELE a.csv", "RNFR a.csv.part", "RNTO a.csv"},
+			map[string]string{"a.csv.part": "new"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newFTPStub(t, map[string]string{"a.csv": "old"})
+			stub.fail["RNTO"] = tt.failRenames
+			client := stub.dial(t)
+			src := pushSource{Name: "a.csv", Open: func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("new")), nil }}
+			if err := pushFile(client, src); (err != nil) != tt.wantErr {
+				t.Fatalf("pushFile: %v, want error %v", err, tt.wantErr)
+			}
+			if got := stub.received(); !reflect.DeepEqual(got, tt.commands) {
+				t.Errorf("commands %v, want %v", got, tt.commands)
+			}
+			stub.mu.Lock()
+			files := make(map[string]string)
+			for name, data := range stub.files {
+				files[name] = string(data)
+			}
+			stub.mu.Unlock()
+			if !reflect.DeepEqual(files, tt.files) {
+				t.Errorf("files on the server %v, want %v", files, tt.files)
+			}
+		})
+	}
+}
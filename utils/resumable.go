@@ -0,0 +1,251 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// endpoint used to start the resumable upload sessions (JSON API)
+const resumableUploadURL = "https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=resumable&name=%s"
+
+// Cloud Storage requires every chunk (but the last one) to be a multiple of 256 KiB
+const chunkGranularity = 256 * 1024
+
+// Cloud Storage keeps a resumable session alive for a week: sessions older than this are started again
+const sessionMaxAge = 6 * 24 * time.Hour
+
+// uploadSession is a resumable upload session started for an object and not completed yet
+type uploadSession struct {
+	URI     string    // session URI returned by Cloud Storage
+	Size    int64     // total size of the object
+	MD5     [16]byte  // hash of the data the session was started with
+	Started time.Time // when the session was started
+}
+
+/*
+uploadProgressError is returned by resumableUpload when an attempt fails.
+Advanced reports whether the attempt committed at least one chunk, so that the caller can tell
+a slow (but working) upload from one that is not moving at all.
+*/
+type uploadProgressError struct {
+	Committed int64
+	Size      int64
+	Advanced  bool
+	Err       error
+}
+
+func (e *uploadProgressError) Error() string {
+	return fmt.Sprintf("upload interrupted at %d/%d bytes: %v", e.Committed, e.Size, e.Err)
+}
+
+func (e *uploadProgressError) Unwrap() error {
+	return e.Err
+}
+
+/*
+resumableUpload uploads the data to the object at filePath using a resumable upload session, one chunk
+(of c.ChunkSize bytes) per request. If a previous attempt for the same object (and the same data) failed, its
+session is reused and the upload continues from the last chunk committed by Cloud Storage instead of
+restarting from byte zero.
+*/
+func (c *ClientCloudStorage) resumableUpload(ctx context.Context, filePath string, file FileToUpload) error {
+	data := file.Data
+	sum := md5.Sum(data)
+	size := int64(len(data))
+
+	c.mu.Lock()
+	session, ok := c.sessions[filePath]
+	c.mu.Unlock()
+	if ok && (session.MD5 != sum || time.Since(session.Started) > sessionMaxAge) {
+		ok = false // the session refers to different data or it's expired
+	}
+
+	var offset int64
+	if ok {
+		committed, done, err := c.querySession(ctx, session)
+		if err != nil {
+			return &uploadProgressError{Size: size, Err: err}
+		}
+		if done {
+			c.dropSession(filePath)
+			return nil
+		}
+		if committed < 0 { // the session is no longer valid
+			ok = false
+		} else {
+			offset = committed
+			slog.Debug("Resuming upload", "object", filePath, "offset", offset, "size", size)
+		}
+	}
+	if !ok {
+		uri, err := c.startSession(ctx, filePath, file, sum)
+		if err != nil {
+			return err
+		}
+		session = &uploadSession{URI: uri, Size: size, MD5: sum, Started: time.Now()}
+		c.mu.Lock()
+		c.sessions[filePath] = session
+		c.mu.Unlock()
+	}
+
+	start := offset
+	for offset < size {
+		end := offset + int64(c.chunkSize())
+		if end > size {
+			end = size
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, session.URI, bytes.NewReader(data[offset:end]))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = end - offset
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, size))
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return &uploadProgressError{Committed: offset, Size: size, Advanced: offset > start, Err: err}
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+			c.dropSession(filePath)
+			return nil
+		case resp.StatusCode == http.StatusPermanentRedirect: // 308: chunk committed, more data expected
+			offset = committedBytes(resp)
+		case resp.StatusCode == http.StatusPreconditionFailed:
+			c.dropSession(filePath)
+			return c.checkExistingObject(ctx, filePath, data)
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			c.dropSession(filePath) // the next attempt will start a new session
+			return &uploadProgressError{Committed: offset, Size: size, Err: fmt.Errorf("upload session expired")}
+		default:
+			return &uploadProgressError{Committed: offset, Size: size, Advanced: offset > start, Err: fmt.Errorf("unexpected status %s", resp.Status)}
+		}
+	}
+	return nil
+}
+
+/*
+startSession starts a new resumable upload session for the object and returns its URI.
+In "create only" mode the session is started with the ifGenerationMatch=0 precondition (the equivalent of DoesNotExist).
+*/
+func (c *ClientCloudStorage) startSession(ctx context.Context, filePath string, file FileToUpload, sum [16]byte) (string, error) {
+	endpoint := fmt.Sprintf(resumableUploadURL, url.PathEscape(c.BucketName), url.QueryEscape(filePath))
+	if c.CreateOnly {
+		endpoint += "&ifGenerationMatch=0"
+	}
+	size := int64(len(file.Data))
+	body, err := json.Marshal(map[string]interface{}{
+		"name":            filePath,
+		"md5Hash":         base64.StdEncoding.EncodeToString(sum[:]),
+		"contentEncoding": file.ContentEncoding,
+		"metadata":        file.Metadata,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("starting upload session: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return "", &preconditionFailedError{}
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("starting upload session: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	uri := resp.Header.Get("Location")
+	if uri == "" {
+		return "", fmt.Errorf("starting upload session: missing session URI")
+	}
+	return uri, nil
+}
+
+/*
+querySession asks Cloud Storage how many bytes of the session were committed.
+It returns done=true if the upload was already completed and committed=-1 if the session is no longer valid.
+*/
+func (c *ClientCloudStorage) querySession(ctx context.Context, session *uploadSession) (committed int64, done bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, session.URI, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.ContentLength = 0
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", session.Size))
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, false, fmt.Errorf("querying upload session: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return session.Size, true, nil
+	case http.StatusPermanentRedirect:
+		return committedBytes(resp), false, nil
+	case http.StatusNotFound, http.StatusGone:
+		return -1, false, nil
+	default:
+		return 0, false, fmt.Errorf("querying upload session: unexpected status %s", resp.Status)
+	}
+}
+
+// committedBytes parses the "Range: bytes=0-N" header of a 308 response and returns the number of bytes committed (N+1)
+func committedBytes(resp *http.Response) int64 {
+	r := resp.Header.Get("Range")
+	if !strings.HasPrefix(r, "bytes=0-") {
+		return 0 // nothing committed yet
+	}
+	last, err := strconv.ParseInt(strings.TrimPrefix(r, "bytes=0-"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return last + 1
+}
+
+// dropSession forgets the upload session started for the object
+func (c *ClientCloudStorage) dropSession(filePath string) {
+	c.mu.Lock()
+	delete(c.sessions, filePath)
+	c.mu.Unlock()
+}
+
+// chunkSize returns the configured chunk size rounded up to a multiple of 256 KiB
+func (c *ClientCloudStorage) chunkSize() int {
+	size := c.ChunkSize
+	if size <= 0 {
+		size = defaultChunkSize
+	}
+	if rem := size % chunkGranularity; rem != 0 {
+		size += chunkGranularity - rem
+	}
+	return size
+}
+
+// preconditionFailedError is returned when Cloud Storage refuses to start an upload session because of a failed precondition
+type preconditionFailedError struct{}
+
+func (e *preconditionFailedError) Error() string {
+	return "precondition failed"
+}
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// gcsStub is the JSON API of the resumable uploads, whose chunk uploads fail when failChunk is set
+type gcsStub struct {
+	mu        sync.Mutex
+	sessions  int      // sessions started
+	ranges    []string // Content-Range of the PUT requests
+	data      []byte   // bytes committed
+	failChunk bool     // the next chunk upload fails (without being committed)
+}
+
+func (s *gcsStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Method == http.MethodPost {
+		s.sessions++
+		s.data = nil
+		w.Header().Set("Location", fmt.Sprintf("http://%s/session/%d", r.Host, s.sessions))
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	cr := r.Header.Get("Content-Range")
+	s.ranges = append(s.ranges, cr)
+	var first, last, size int64
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &first, &last, &size); err == nil {
+		if s.failChunk {
+			s.failChunk = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if first != int64(len(s.data)) {
+			w.WriteHeader(http.StatusBadRequest) // the client must continue from the bytes committed
+			return
+		}
+		s.data = append(s.data, body...)
+	} else if _, err := fmt.Sscanf(cr, "bytes */%d", &size); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if int64(len(s.data)) == size {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if len(s.data) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.data)-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+// redirectTransport sends all the requests to the test server
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestResumableUploadRestart(t *testing.T) {
+	stub := &gcsStub{}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	// the first chunk is committed, the second one fails
+	c := &ClientCloudStorage{BucketName: "bucket", ChunkSize: chunkGranularity, sessions: make(map[string]*uploadSession),
+		HTTPClient: &http.Client{Transport: &failingTransport{RoundTripper: redirectTransport{target}, stub: stub}}}
+	data := bytes.Repeat([]byte("0123456789abcdef"), 3*chunkGranularity/16) // 3 chunks
+	file := FileToUpload{Data: data, Filename: "a.csv"}
+	err := c.resumableUpload(context.Background(), "line3/a.csv", file)
+	var pErr *uploadProgressError
+	if !errors.As(err, &pErr) || pErr.Committed != chunkGranularity || !pErr.Advanced {
+		t.Fatalf("first attempt: %v, want interrupted at %d bytes", err, chunkGranularity)
+	}
+
+	// the next attempt continues from the bytes committed, in the same session
+	c.HTTPClient.Transport = redirectTransport{target}
+	if err := c.resumableUpload(context.Background(), "line3/a.csv", file); err != nil {
+		t.Fatalf("second attempt: %v", err)
+	}
+	if stub.sessions != 1 {
+		t.Errorf("%d sessions started, want 1", stub.sessions)
+	}
+	want := []string{
+		"bytes 0-262143/786432", "bytes 262144-524287/786432", // first attempt
+		"bytes */786432", "bytes 262144-524287/786432", "bytes 524288-786431/786432", // query, then the rest
+	}
+	if strings.Join(stub.ranges, ", ") != strings.Join(want, ", ") {
+		t.Errorf("requests %v, want %v", stub.ranges, want)
+	}
+	if !bytes.Equal(stub.data, data) {
+		t.Error("the object uploaded is different from the data")
+	}
+	if len(c.sessions) != 0 {
+		t.Error("the session of the completed upload is still kept")
+	}
+
+	// other data for the same object: a new session is started
+	stub.ranges = nil
+	if err := c.resumableUpload(context.Background(), "line3/a.csv", FileToUpload{Data: []byte("v2"), Filename: "a.csv"}); err != nil {
+		t.Fatalf("new version: %v", err)
+	}
+	if stub.sessions != 2 || !bytes.Equal(stub.data, []byte("v2")) {
+		t.Errorf("sessions %d, object %q: want 2 sessions and the new version", stub.sessions, stub.data)
+	}
+}
+
+// failingTransport makes the stub fail the second chunk upload (of the session)
+type failingTransport struct {
+	http.RoundTripper
+	stub *gcsStub
+	puts int
+}
+
+func (t *failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method == http.MethodPut {
+		if t.puts++; t.puts == 2 {
+			t.stub.mu.Lock()
+			t.stub.failChunk = true
+			t.stub.mu.Unlock()
+		}
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
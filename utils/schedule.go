@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"fmt"
+	"ftp-client/model"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // the time zones are available even if the system has no tz database (e.g. alpine)
+
+	"github.com/robfig/cron/v3"
+)
+
+// max time searched for the next poll allowed by the windows (they repeat every week)
+const scheduleHorizon = 8 * 24 * time.Hour
+
+// max number of times of the cron expression checked against the windows
+const maxCronTimes = 100000
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+/*
+Scheduler decides when the server is polled: at the times of its cron expression or, if not set, every "sampling"
+milliseconds. The polls are allowed only inside the windows (if any) and outside the blackout windows.
+*/
+type Scheduler struct {
+	cron      cron.Schedule // nil: fixed interval
+	interval  time.Duration
+	loc       *time.Location
+	windows   []window
+	blackouts []window
+}
+
+// window is a parsed model.Window (the times are minutes from midnight)
+type window struct {
+	days       [7]bool
+	start, end int
+}
+
+// NewScheduler returns the scheduler of the server
+func NewScheduler(conf model.Server) (*Scheduler, error) {
+	s := &Scheduler{interval: time.Duration(conf.Sampling) * time.Millisecond, loc: time.Local}
+	sch := conf.Schedule
+	if sch == nil {
+		return s, nil
+	}
+	if sch.Timezone != "" {
+		loc, err := time.LoadLocation(sch.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %q", sch.Timezone)
+		}
+		s.loc = loc
+	}
+	if sch.Cron != "" {
+		c, err := cron.ParseStandard(sch.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %v", sch.Cron, err)
+		}
+		s.cron = c
+	}
+	var err error
+	if s.windows, err = parseWindows(sch.Windows, "windows"); err != nil {
+		return nil, err
+	}
+	if s.blackouts, err = parseWindows(sch.Blackouts, "blackouts"); err != nil {
+		return nil, err
+	}
+	// a schedule that never polls is a mistake (e.g. a cron expression outside the windows)
+	if s.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("the server would never be polled: check the cron expression and the windows")
+	}
+	return s, nil
+}
+
+// Allowed reports whether the server can be polled at the given time
+func (s *Scheduler) Allowed(t time.Time) bool {
+	t = t.In(s.loc)
+	if len(s.windows) > 0 && !anyContains(s.windows, t) {
+		return false
+	}
+	return !anyContains(s.blackouts, t)
+}
+
+// InBlackout reports whether the given time is inside a blackout window, when the server must not be connected
+func (s *Scheduler) InBlackout(t time.Time) bool {
+	return anyContains(s.blackouts, t.In(s.loc))
+}
+
+/*
+First returns when the first poll must be done: now if the fixed interval is used and the polls are allowed,
+otherwise the next allowed time (zero if there's none).
+*/
+func (s *Scheduler) First(now time.Time) time.Time {
+	if s.cron == nil {
+		return s.nextAllowed(now)
+	}
+	return s.Next(now)
+}
+
+// Next returns when the next poll must be done, after the one done at the given time (zero if there's none)
+func (s *Scheduler) Next(last time.Time) time.Time {
+	if s.cron == nil {
+		return s.nextAllowed(last.Add(s.interval))
+	}
+	t := last.In(s.loc)
+	for i := 0; i < maxCronTimes; i++ {
+		t = s.cron.Next(t)
+		if t.IsZero() || s.Allowed(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// nextAllowed returns the first time, from the given one, when the polls are allowed (zero if there's none)
+func (s *Scheduler) nextAllowed(t time.Time) time.Time {
+	if s.Allowed(t) {
+		return t
+	}
+	// the windows start and end on a minute
+	for c := t.Truncate(time.Minute).Add(time.Minute); c.Sub(t) < scheduleHorizon; c = c.Add(time.Minute) {
+		if s.Allowed(c) {
+			return c
+		}
+	}
+	return time.Time{}
+}
+
+func anyContains(windows []window, t time.Time) bool {
+	for _, w := range windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether the time (in the time zone of the schedule) is inside the window
+func (w window) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// the window ends the next day: it started today or the day before
+	yesterday := (day + 6) % 7
+	return (w.days[day] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+func parseWindows(windows []model.Window, field string) ([]window, error) {
+	parsed := make([]window, len(windows))
+	for i, w := range windows {
+		var err error
+		if parsed[i].days, err = parseDays(w.Days); err == nil {
+			if parsed[i].start, err = parseClock(w.Start); err == nil {
+				parsed[i].end, err = parseClock(w.End)
+			}
+		}
+		if err == nil && parsed[i].start == parsed[i].end {
+			err = fmt.Errorf("start and end are the same")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %v", field, i, err)
+		}
+	}
+	return parsed, nil
+}
+
+// parseDays parses a list of days or ranges of days, e.g. "mon-fri,sun"
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || s == "*" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		first, ok1 := weekdays[from]
+		last, ok2 := first, true
+		if isRange {
+			last, ok2 = weekdays[to]
+		}
+		if !ok1 || !ok2 {
+			return days, fmt.Errorf("invalid days %q (e.g. \"mon-fri\", \"sat,sun\")", part)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock parses a time of the day (HH:MM) and returns the minutes from midnight
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM)", s)
+	}
+	return hours*60 + minutes, nil
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"ftp-client/model"
+	"testing"
+	"time"
+)
+
+func TestSchedulerWindows(t *testing.T) {
+	rome, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day, hour, minute int) time.Time { return time.Date(2026, 10, day, hour, minute, 0, 0, rome) } // 19 is a Monday
+	s, err := NewScheduler(model.Server{Sampling: 60000, Schedule: &model.Schedule{
+		Timezone:  "Europe/Rome",
+		Windows:   []model.Window{{Days: "mon-fri", Start: "22:00", End: "06:00"}, {Days: "sat", Start: "10:00", End: "12:00"}},
+		Blackouts: []model.Window{{Days: "wed", Start: "23:00", End: "24:00"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		t    time.Time
+		want bool
+	}{
+		{"monday night", at(19, 23, 30), true},
+		{"the overnight window ends on tuesday", at(20, 5, 59), true},
+		{"end of the overnight window", at(20, 6, 0), false},
+		{"monday morning, before the first window of the week", at(19, 3, 0), false},
+		{"saturday morning, after friday's window", at(24, 3, 0), true},
+		{"sunday morning", at(25, 3, 0), false},
+		{"saturday window", at(24, 11, 0), true},
+		{"wednesday blackout", at(21, 23, 30), false},
+		{"after the wednesday blackout", at(22, 0, 0), true},
+		{"utc time in the window", time.Date(2026, 10, 19, 21, 30, 0, 0, time.UTC), true}, // 23:30 in Rome
+	}
+	for _, tt := range tests {
+		if got := s.Allowed(tt.t); got != tt.want {
+			t.Errorf("%s (%s): Allowed = %v, want %v", tt.name, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+	// the next poll after the end of a window is at the start of the next one
+	if got, want := s.Next(at(20, 5, 59)), at(20, 22, 0); !got.Equal(want) {
+		t.Errorf("Next = %s, want %s", got, want)
+	}
+	if got, want := s.Next(at(21, 22, 59)), at(22, 0, 0); !got.Equal(want) {
+		t.Errorf("Next before the blackout = %s, want %s", got, want)
+	}
+}
+
+func TestSchedulerCron(t *testing.T) {
+	rome, _ := time.LoadLocation("Europe/Rome")
+	s, err := NewScheduler(model.Server{Schedule: &model.Schedule{
+		Cron:     "0 * * * *",
+		Timezone: "Europe/Rome",
+		Windows:  []model.Window{{Days: "mon-fri", Start: "09:30", End: "11:30"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// friday 11:00 is the last time inside the windows: the next one is on monday
+	friday := time.Date(2026, 10, 23, 11, 0, 0, 0, rome)
+	if got, want := s.Next(friday), time.Date(2026, 10, 26, 10, 0, 0, 0, rome); !got.Equal(want) {
+		t.Errorf("Next = %s, want %s", got, want)
+	}
+
+	// a cron expression that never fires inside the windows is refused
+	_, err = NewScheduler(model.Server{Schedule: &model.Schedule{
+		Cron:    "0 12 * * *",
+		Windows: []model.Window{{Start: "22:00", End: "06:00"}},
+	}})
+	if err == nil {
+		t.Error("NewScheduler: the cron expression outside the windows was accepted")
+	}
+}
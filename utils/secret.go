@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"ftp-client/model"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/api/option"
+)
+
+/*
+ResolveSecret returns the secret referenced by the value: env:NAME is the content of the environment variable NAME,
+file:/path is the content of the file (without the trailing newline). Any other value is the secret itself.
+The netrc references depend on the server, so they're resolved by FTPCredentials.
+*/
+func ResolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, model.SecretEnv):
+		name := strings.TrimPrefix(value, model.SecretEnv)
+		secret, ok := os.LookupEnv(name)
+		if !ok || secret == "" {
+			return "", fmt.Errorf("environment variable %s not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, model.SecretFile):
+		path := strings.TrimPrefix(value, model.SecretFile)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading secret: %v", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	return value, nil
+}
+
+/*
+FTPCredentials returns the user and the password to login to the FTP server, resolving the secret reference of
+the password (see ResolveSecret). With "netrc" (or "netrc:/path") the password is the one of the server's host
+in the netrc file ($NETRC or ~/.netrc by default); if "user" is not set, the login of the netrc file is used as well.
+*/
+func FTPCredentials(conf model.Server) (string, string, error) {
+	value := string(conf.Password)
+	if value != model.SecretNetrc && !strings.HasPrefix(value, model.SecretNetrc+":") {
+		password, err := ResolveSecret(value)
+		return conf.User, password, err
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(value, model.SecretNetrc), ":")
+	if path == "" {
+		path = defaultNetrcFile()
+	}
+	login, password, err := netrcLookup(path, conf.Host, conf.User)
+	if err != nil {
+		return "", "", err
+	}
+	if conf.User != "" {
+		login = conf.User
+	}
+	return login, password, nil
+}
+
+// CloudCredentials returns the option with the credentials of Cloud Storage: a file, or the JSON key in an env variable
+func CloudCredentials(cs model.CloudStorage) (option.ClientOption, error) {
+	if strings.HasPrefix(cs.CredentialsPath, model.SecretEnv) {
+		key, err := ResolveSecret(cs.CredentialsPath)
+		if err != nil {
+			return nil, err
+		}
+		return option.WithCredentialsJSON([]byte(key)), nil
+	}
+	return option.WithCredentialsFile(strings.TrimPrefix(cs.CredentialsPath, model.SecretFile)), nil
+}
+
+// defaultNetrcFile returns the netrc file used if "netrc" has no path
+func defaultNetrcFile() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".netrc"
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+/*
+netrcLookup returns the login and password of the machine in the netrc file. If user is set, only the entries
+with that login match. The "default" entry is used if no machine matches.
+*/
+func netrcLookup(path, host, user string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", fmt.Errorf("reading netrc: %v", err)
+	}
+	defer f.Close()
+
+	type entry struct{ machine, login, password string }
+	var entries []entry
+	var cur *entry
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanWords)
+	next := func() string {
+		if scanner.Scan() {
+			return scanner.Text()
+		}
+		return ""
+	}
+	for scanner.Scan() {
+		switch scanner.Text() {
+		case "machine":
+			entries = append(entries, entry{machine: next()})
+			cur = &entries[len(entries)-1]
+		case "default":
+			entries = append(entries, entry{})
+			cur = &entries[len(entries)-1]
+		case "login":
+			if login := next(); cur != nil {
+				cur.login = login
+			}
+		case "password":
+			if password := next(); cur != nil {
+				cur.password = password
+			}
+		case "macdef":
+			// the macros are not supported: their tokens are ignored up to the next entry
+			cur = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", fmt.Errorf("reading netrc: %v", err)
+	}
+	for _, machine := range []string{host, ""} {
+		for _, e := range entries {
+			if e.machine == machine && (user == "" || e.login == user || e.login == "") {
+				return e.login, e.password, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("no entry for %s in %s", host, path)
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"ftp-client/model"
+	"ftp-client/state"
+	"log/slog"
+	"regexp"
+	"strconv"
+)
+
+// port of the FTP servers if "port" is not set
+const DefaultFTPPort = 21
+
+// characters allowed in a source ID (it's used in file names and in object paths)
+var sourceIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// characters of the host replaced in a derived source ID
+var unsafeIDChars = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+// FTPPort returns the port of the FTP server
+func FTPPort(conf model.Server) int {
+	if conf.Port == 0 {
+		return DefaultFTPPort
+	}
+	return conf.Port
+}
+
+/*
+SourceID returns the ID that identifies the FTP server: it's the key of its state, the name of its log file,
+of its local folder (<data dir>/<id>/) and of its prefix in the bucket.
+The explicit "id" is used if set. Otherwise the ID is derived from the host, port, user and dir_path of the server
+(e.g. "192.168.1.10-3f2a9c1e"), so it doesn't change as long as the server's connection doesn't.
+*/
+func SourceID(conf model.Server) string {
+	if conf.ID != "" {
+		return conf.ID
+	}
+	sum := sha256.Sum256([]byte(conf.Host + "\x00" + strconv.Itoa(FTPPort(conf)) + "\x00" + conf.User + "\x00" + conf.DirPath))
+	return unsafeIDChars.ReplaceAllString(conf.Host, "_") + "-" + hex.EncodeToString(sum[:4])
+}
+
+// validSourceID checks that the ID can be used in file names and object paths
+func validSourceID(id string) bool {
+	return sourceIDPattern.MatchString(id) && id != "." && id != ".."
+}
+
+/*
+MigrateStateKeys moves the state saved with the server_name as key (before the source IDs were introduced) to the
+source ID of the server. The state of a server_name shared by more servers is ambiguous, so it's left untouched.
+*/
+func MigrateStateKeys(store state.Store, servers []model.Server) error {
+	names := make(map[string]int, len(servers))
+	for _, s := range servers {
+		names[s.ServerName]++
+	}
+	for _, s := range servers {
+		id := SourceID(s)
+		if s.ServerName == id || names[s.ServerName] > 1 {
+			continue
+		}
+		for _, keys := range [][2]string{{s.ServerName, id}, {PushStateKey(s.ServerName), PushStateKey(id)}} {
+			moved, err := store.RenameSource(keys[0], keys[1])
+			if err != nil {
+				return fmt.Errorf("migrating the state of %q: %v", keys[0], err)
+			}
+			if moved {
+				slog.Info("State moved", "from", keys[0], "to", keys[1])
+			}
+		}
+	}
+	return nil
+}
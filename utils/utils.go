@@ -1,10 +1,14 @@
 package utils
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"ftp-client/events"
 	"ftp-client/model"
+	"ftp-client/state"
 	"log"
+	"log/slog"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -15,17 +19,6 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-/* Load configuration loads the configuration file and returns the corresponding object */
-func LoadConfiguration(file string) model.Config {
-	var config model.Config
-	f, err := os.ReadFile(file)
-	if err != nil {
-		log.Println(err)
-	}
-	json.Unmarshal([]byte(f), &config)
-	return config
-}
-
 // StringToInt converts the string parameter returning an int
 func StringToInt(name string) int {
 	val, err := strconv.Atoi(name)
@@ -45,44 +38,112 @@ func GetIntEnv(name string) int {
 	return val
 }
 
-// InitLogger initialize a logger for each client that connects to a different host
-func InitLogger(config model.Config, host string) *log.Logger {
+/*
+InitLogger initialize a logger for each client that connects to a different host: the records are written
+to the console (stdout, see SetLogConsole) and to the <log dir>/<name>.log file, with the level and the format
+of the log configuration.
+*/
+func InitLogger(config model.Config, name string) *slog.Logger {
 	// load logger
-	filename := fmt.Sprintf("./log/%s.log", host)
+	filename := LogFile(name)
 	e, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
-		fmt.Printf("error opening %s file: %v\n", filename, err)
+		fmt.Fprintf(logConsole(), "error opening %s file: %v\n", filename, err)
 		os.Exit(1)
 	}
-	logger := log.New(e, "", log.Ldate|log.Ltime|log.Lmsgprefix)
-	logger.SetOutput(&lumberjack.Logger{
-		Filename:   filename,
-		MaxSize:    config.Log.Size,    // megabytes after which new file is created
-		MaxBackups: config.Log.Backups, // number of backups
-		MaxAge:     config.Log.Age,     // days
-	})
-	return logger
+	e.Close() // the file is only checked: the logger writes through the rotated writer
+	setLogOptions(config.Log)
+	return slog.New(newLogHandler(logConsole(), NewLogWriter(config, name)))
+}
+
+/*
+LogWriter writes to the <log dir>/<name>.log file, rotated according to the log configuration.
+The rotation settings can be changed while the connector is running (see ApplyLogConfig).
+*/
+type LogWriter struct {
+	mu sync.Mutex
+	w  *lumberjack.Logger
+}
+
+var (
+	logWritersMu sync.Mutex
+	logWriters   = make(map[string]*LogWriter) // key: name of the log file
+)
+
+/*
+NewLogWriter returns a writer to the <log dir>/<name>.log file, rotated according to the log configuration.
+The writers are shared: the same writer is returned for the same name (e.g. when a server's goroutine is restarted).
+*/
+func NewLogWriter(config model.Config, name string) *LogWriter {
+	logWritersMu.Lock()
+	defer logWritersMu.Unlock()
+	if w, ok := logWriters[name]; ok {
+		return w
+	}
+	w := &LogWriter{w: newRotatedFile(config.Log, name)}
+	logWriters[name] = w
+	return w
+}
+
+func newRotatedFile(l model.Log, name string) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   LogFile(name),
+		MaxSize:    l.Size,    // megabytes after which new file is created
+		MaxBackups: l.Backups, // number of backups
+		MaxAge:     l.Age,     // days
+	}
+}
+
+func (l *LogWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// ApplyLogConfig applies the given level, format and rotation settings to all the loggers and log files
+func ApplyLogConfig(conf model.Log) {
+	setLogOptions(conf)
+	logWritersMu.Lock()
+	defer logWritersMu.Unlock()
+	for name, w := range logWriters {
+		w.mu.Lock()
+		w.w.Close()
+		w.w = newRotatedFile(conf, name)
+		w.mu.Unlock()
+	}
+}
+
+// CloseLogWriter closes the log file with the given name (e.g. the one of a server removed from the configuration)
+func CloseLogWriter(name string) {
+	logWritersMu.Lock()
+	defer logWritersMu.Unlock()
+	if w, ok := logWriters[name]; ok {
+		w.mu.Lock()
+		w.w.Close()
+		w.mu.Unlock()
+		delete(logWriters, name)
+	}
 }
 
 // CheckDirectory checks if directory exists in the CURRENT local path ("./").
 // Otherwise it will create it.
 func CheckDirectory(path string) {
 	if stat, err := os.Stat(path); err == nil && stat.IsDir() {
-		fmt.Printf("Directory %s found\n", path)
+		slog.Debug("Directory found", "path", path)
 	} else {
 		err = os.MkdirAll(path, 0750)
 		if err != nil && !os.IsExist(err) {
 			log.Fatal("Error creating directory ", path, ": ", err)
 		}
-		fmt.Printf("Directory created at %s\n", path)
+		slog.Info("Directory created", "path", path)
 	}
 }
 
 // ChangeDirectory changes the directory of an FTP client to the one specified by the env var
-func ChangeDirectory(client *ftp.ServerConn, conf *model.Server, logger *log.Logger) error {
+func ChangeDirectory(client *ftp.ServerConn, conf *model.Server, logger *slog.Logger) error {
 	var DIR_PATH []string // slice that contains the desidered path splitted
 	dir, _ := client.CurrentDir()
-	fmt.Printf("[GOROUTINE for %s] -> Current remote dir: %s\n", conf.Host, dir)
+	logger.Debug("Current remote dir", "dir", dir)
 	if !strings.Contains(conf.DirPath, "/") && !strings.Contains(conf.DirPath, "\\") {
 		DIR_PATH = append(DIR_PATH, conf.DirPath)
 	} else if strings.Contains(conf.DirPath, "/") {
@@ -92,55 +153,20 @@ func ChangeDirectory(client *ftp.ServerConn, conf *model.Server, logger *log.Log
 	}
 
 	for _, value := range DIR_PATH {
-		fmt.Printf("[GOROUTINE for %s] -> Changing dir to %s\n", conf.Host, value)
+		if value == "" {
+			continue // empty dir_path or leading/trailing separator
+		}
+		logger.Debug("Changing dir", "dir", value)
 		// change CWD
 		err := client.ChangeDir(value)
 		if err != nil {
-			logger.Printf("Error while changing directory to %s\n", value)
+			logger.Error("Error while changing directory", "dir", value, "error", err)
 			return err
 		}
 	}
 	return nil
 }
 
-/*
-LoadInfoDownloadedFile will unmarshal the "/log/log.json" file to the map
-provided as parameter
-*/
-func LoadInfoDownloadedFile(storage map[string]map[string]uint64) {
-	// read the json file as byte array (if the file exists)
-	b, err := os.ReadFile("./log/log.json")
-	if err != nil {
-		fmt.Println("Error reading log.json: ", err)
-	}
-	// if the file exists (#bytes read > 0) unmarshal the json into the map
-	if len(b) > 0 {
-		json.Unmarshal(b, &storage)
-	}
-
-}
-
-/*
-SaveFilesInfo will marshal the given map and write it to the file.
-The mutex passed as parameter is used to lock the map while writing it (to avoid race conditions)
-*/
-func SaveFilesInfo(mut *sync.Mutex, storage map[string]map[string]uint64, dir string) {
-	mut.Lock()
-	jsonStr, err := json.Marshal(storage)
-	if err != nil {
-		mut.Unlock() // free the resource if there are errors
-		fmt.Printf("Error while saving to file: %s\n", err)
-		log.Fatal(err)
-	}
-
-	err = os.WriteFile("./log/log.json", jsonStr, 0644) // RW permission for user, R only for Group and Others
-	if err != nil {
-		mut.Unlock() // free the resource if there are errors
-		log.Fatal(err)
-	}
-	mut.Unlock()
-}
-
 /*
 GetFilenameFormatted will convert the filename provided to the following format: <filename>__<date>__<hours-minutes-seconds>.<extension>
 */
@@ -156,42 +182,118 @@ func GetFilenameFormatted(file *ftp.Entry, ext string) string {
 }
 
 /*
-UpdateMap is used to store file's information (name and timestamp for each host) with the newer version found for the given file.
+DeliveredFilename returns the name of the copies of the version of the file (with the given timestamp), both
+the object in the bucket and the local file, before the suffixes of the compression and the encryption.
+The extension is the one of the file, even if the server is configured with "file_ext": "*".
 */
-func UpdateMap(storage map[string]map[string]uint64, m *sync.Mutex, serverName string, f *ftp.Entry) {
-	m.Lock()
-	if _, ok := storage[serverName]; !ok { // initialize the inner map (with initial key == HOST) and insert the value
-		storage[serverName] = map[string]uint64{}
+func DeliveredFilename(name string, timestamp uint64) string {
+	tmp := strings.Split(name, ".")
+	return GetFilenameFormatted(&ftp.Entry{Name: name, Time: time.Unix(int64(timestamp), 0)}, tmp[len(tmp)-1])
+}
+
+/*
+UpdateFileInfo is used to store file's information (name and timestamp for each server) with the newer version found for the given file.
+The version is only marked as seen: it's marked as delivered by RecordDelivery, once its delivery is confirmed.
+The version is added to the file's history, which keeps at most "limit" versions (the oldest ones are dropped).
+*/
+func UpdateFileInfo(store state.Store, serverName string, f *ftp.Entry, limit int) error {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
 	}
-	// the file wasn't previously downloaded => save its info in the storage
-	storage[serverName][f.Name] = uint64(f.Time.Unix())
-	m.Unlock()
+	// the file wasn't previously downloaded (or it's a newer version) => save its info in the state
+	return store.Update(serverName, f.Name, func(info *model.FileInfo, ok bool) error {
+		versions := append(info.Versions, model.Version{
+			DetectedAt: time.Now().UTC(),
+			Timestamp:  uint64(f.Time.Unix()),
+			Size:       f.Size,
+			Status:     VersionDetected,
+		})
+		if len(versions) > limit {
+			versions = versions[len(versions)-limit:]
+		}
+		// the delivered version is kept, unless the file was deleted from the server (it's tracked again from scratch)
+		delivered := info.Delivered
+		if info.Deleted != 0 {
+			delivered = 0
+		}
+		*info = model.FileInfo{Timestamp: uint64(f.Time.Unix()), Delivered: delivered, Versions: versions}
+		return nil
+	})
 }
 
 /*
 NewClientFTP will initialize an FTP client starting from the configuration object passed as parameter.
 That client is then returned
 */
-func NewClientFTP(conf model.Server, logger *log.Logger) (*ftp.ServerConn, error) {
-	for {
-		client, err := ftp.Dial(conf.Host+":21", ftp.DialWithTimeout(5*time.Second)) // connect to HOST at port 21
+func NewClientFTP(conf model.Server, logger *slog.Logger) (*ftp.ServerConn, error) {
+	return NewClientFTPContext(context.Background(), conf, logger)
+}
+
+// servers whose last connection attempt failed (see NewClientFTPContext)
+var (
+	unreachableMu sync.Mutex
+	unreachable   = make(map[string]bool) // key: source ID of the server
+)
+
+// setUnreachable records whether the last connection attempt to the server failed, and reports whether it changed
+func setUnreachable(id string, failed bool) bool {
+	unreachableMu.Lock()
+	defer unreachableMu.Unlock()
+	if unreachable[id] == failed {
+		return false
+	}
+	if failed {
+		unreachable[id] = true
+	} else {
+		delete(unreachable, id)
+	}
+	return true
+}
+
+/*
+NewClientFTPContext is like NewClientFTP, but it stops retrying the connection (returning the context's error)
+when the context is canceled, e.g. because the server was removed from the configuration.
+A failed attempt emits the server_unreachable event, the first connection after it the server_recovered one.
+The state is kept for each server, whatever the call that connects: an outage is ended even if the call that saw it
+was canceled (e.g. the goroutine of the server was restarted by a reload).
+*/
+func NewClientFTPContext(ctx context.Context, conf model.Server, logger *slog.Logger) (*ftp.ServerConn, error) {
+	// the password may be a reference to a secret (env:, file: or netrc)
+	user, password, err := FTPCredentials(conf)
+	if err != nil {
+		return nil, fmt.Errorf("reading the credentials of %s: %v", conf.Host, err)
+	}
+	id := SourceID(conf)
+	for attempt := 1; ; attempt++ {
+		client, err := ftp.Dial(net.JoinHostPort(conf.Host, strconv.Itoa(FTPPort(conf))), ftp.DialWithTimeout(5*time.Second)) // connect to HOST at port 21 (or the one configured)
 		if err != nil {
-			fmt.Printf("[GOROUTINE for %s] Cannot reach server\n", conf.Host)
+			logger.Warn("Cannot reach server", "attempt", attempt, "error", err)
 		} else {
-			fmt.Printf("[GOROUTINE for %s] Connection opened\n", conf.Host)
-			err = client.Login(conf.User, conf.Password)
+			logger.Debug("Connection opened", "attempt", attempt)
+			err = client.Login(user, password)
 			if err != nil {
-				fmt.Printf("[GOROUTINE for %s] Error occurred during login\n", conf.Host)
+				logger.Warn("Error occurred during login", "attempt", attempt, "error", err)
+				client.Quit()
 			} else {
-				fmt.Printf("[GOROUTINE for %s] Login succeded\n", conf.Host)
-				err := ChangeDirectory(client, &conf, logger)
-				if err != nil {
-					fmt.Println("Error while changing dir: ", err)
-					return nil, fmt.Errorf("error creating FTP client")
+				logger.Info("Connected", "attempt", attempt)
+				if err := ChangeDirectory(client, &conf, logger); err != nil {
+					// retrying won't help (e.g. the dir_path doesn't exist): the server is not recovered yet
+					client.Quit()
+					return nil, fmt.Errorf("changing to the directory %s: %w", conf.DirPath, err)
+				}
+				if setUnreachable(id, false) {
+					events.Emit(events.Event{Type: events.ServerRecovered, Server: id, Host: conf.Host})
 				}
 				return client, nil
 			}
 		}
-		time.Sleep(time.Duration(conf.RetryConnection) * time.Millisecond)
+		if setUnreachable(id, true) {
+			events.Emit(events.Event{Type: events.ServerUnreachable, Server: id, Host: conf.Host, Error: err.Error()})
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(conf.RetryConnection) * time.Millisecond):
+		}
 	}
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"ftp-client/utils"
+	"os"
+	"text/tabwriter"
+)
+
+/*
+validateCommand checks the configuration file and prints the problems found (with their line and field).
+Usage: validate [config file] (default: the one of the -config global flag)
+It returns the exit code of the command: 0 if the configuration is valid, 1 otherwise.
+*/
+func validateCommand(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: validate [config file] (default: the -config file)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	file := configFile
+	if fs.NArg() == 1 {
+		file = fs.Arg(0)
+	}
+
+	config, err := utils.LoadConfiguration(file)
+	if err != nil {
+		if errs, ok := err.(utils.ConfigErrors); ok {
+			fmt.Printf("%s: %d problem(s) found\n", file, len(errs))
+			for _, e := range errs {
+				fmt.Printf("  %s\n", e)
+			}
+		} else {
+			fmt.Printf("%s: %s\n", file, err)
+		}
+		return 1
+	}
+
+	fmt.Printf("%s: configuration valid, %d servers\n", file, len(config.Servers))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  ID\tSERVER NAME\tADDRESS\tDIRECTORY\tSCHEDULE")
+	for _, s := range config.Servers {
+		schedule := fmt.Sprintf("every %dms", s.Sampling)
+		if s.Schedule != nil && s.Schedule.Cron != "" {
+			schedule = s.Schedule.Cron
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s:%d\t%s\t%s\n", utils.SourceID(s), s.ServerName, s.Host, utils.FTPPort(s), s.DirPath, schedule)
+	}
+	w.Flush()
+	return 0
+}
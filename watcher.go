@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"ftp-client/events"
+	"ftp-client/metrics"
+	"ftp-client/model"
+	"ftp-client/state"
+	"ftp-client/utils"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// time after which the connection is checked before a poll (the FTP servers close the idle connections)
+const idleCheckInterval = time.Minute
+
+/*
+watchServer tracks the files of an FTP server: at every sampling cycle the new files (or the newer versions of
+the files already tracked) are downloaded and uploaded to Cloud Storage (or saved locally), the post-transfer
+actions are run and, in push mode, the files of the push source are uploaded to the server.
+It returns when the context is canceled, once the cycle in progress is completed.
+The connection state and the polls are recorded in health (if not nil), which is read by the health endpoints.
+The polls can be requested and paused with control (if not nil), by the admin API.
+If report is not nil a single cycle is run (once mode): the goroutine waits for the uploads of the files sent to the
+uploader, runs the post-transfer actions on the ones delivered and returns. The outcome is collected in the report.
+The global configuration is used for the settings that can be overridden by each server (compression, encryption, ...).
+*/
+func watchServer(ctx context.Context, clientConf model.Server, config model.Config, logger *slog.Logger,
+	store state.Store, fileChannel chan<- utils.FileToUpload, cloud *utils.CloudSettings,
+	health *serverHealth, control *serverControl, report *serverReport) {
+	logger.Debug("Goroutine started", "config", clientConf)
+	source := utils.SourceID(clientConf) // key of the server's state, local folder and bucket prefix
+	metrics.InitServer(source)
+
+	// the polls are done at the times of the schedule (or every "sampling" ms), outside the blackout windows
+	sched, err := utils.NewScheduler(clientConf)
+	if err != nil {
+		logger.Error("Error in the schedule", "error", err)
+		health.fail(err)
+		report.fail(fmt.Errorf("schedule: %v", err))
+		return
+	}
+	if report != nil {
+		// once mode: the pass is run now, unless the server must not be disturbed
+		if !sched.Allowed(time.Now()) {
+			logger.Info("Outside the windows of the schedule (or in a blackout window): skipped")
+			report.skip("outside the windows of the schedule")
+			return
+		}
+	} else if !waitUntil(ctx, sched.First(time.Now()), health, control, logger) {
+		return
+	}
+
+	setConnected := func(connected bool) {
+		metrics.SetConnected(source, connected)
+		health.setConnected(connected)
+	}
+	var client *ftp.ServerConn // nil while disconnected
+	var cwd string             // current dir of the connection (used later for listing files)
+	/* connect opens the connection to the server. It returns false if the goroutine must return: the context
+	was canceled, or the connection failed in once mode. Otherwise a failed connection (e.g. the dir_path doesn't
+	exist) leaves the client nil, and it's retried at the next poll */
+	connect := func() bool {
+		c, err := utils.NewClientFTPContext(ctx, clientConf, logger)
+		if err == nil {
+			if cwd, err = c.CurrentDir(); err != nil {
+				c.Quit()
+				err = fmt.Errorf("getting the current dir: %v", err)
+			}
+		}
+		if err != nil {
+			logger.Error("Error creating client FTP", "error", err)
+			metrics.PollErrors.WithLabelValues(source).Inc()
+			health.fail(err)
+			report.fail(fmt.Errorf("creating client FTP: %v", err))
+			return ctx.Err() == nil && report == nil
+		}
+		logger.Debug("Current dir", "dir", cwd)
+		client = c
+		setConnected(true)
+		return true
+	}
+	// reconnect opens the connection again, after it was lost (e.g. the server was restarted)
+	reconnect := func() bool {
+		setConnected(false)
+		if client != nil {
+			client.Quit()
+			client = nil
+		}
+		return connect()
+	}
+	if !connect() {
+		return
+	}
+	defer func() {
+		if client != nil {
+			client.Quit()
+		}
+		setConnected(false)
+	}()
+	lastCycle := time.Now()
+
+	var getFile bool // flag to check whether a file needs to be downloaded or not
+	compression := utils.EffectiveCompression(clientConf, config.CloudStorage)
+	encryptor, err := utils.NewEncryptor(utils.EffectiveEncryption(clientConf, config))
+	if err != nil {
+		logger.Error("Error loading encryption key", "error", err)
+		health.fail(err)
+		report.fail(fmt.Errorf("loading encryption key: %v", err))
+		return
+	}
+	// files delivered (to Cloud Storage or locally) waiting for the post-transfer action on the FTP server
+	delivered := utils.NewDeliveredFiles()
+	// files sent to the uploader whose delivery was not confirmed yet
+	inFlight := utils.NewInFlightFiles()
+	// recordDelivery saves the outcome of a delivery in the history of the file
+	// (the outcome is emitted as an event, with the object or the local copy delivered)
+	recordDelivery := func(serverName, name string, timestamp uint64, hash, destination string, err error) {
+		report.delivered(err)
+		event := events.Event{Type: events.FileDelivered, Server: serverName, Host: clientConf.Host, File: name, Hash: hash}
+		if bucket, object, ok := utils.SplitObjectURL(destination); ok {
+			event.Bucket, event.Object = bucket, object
+		} else {
+			event.Local = destination
+		}
+		if err != nil {
+			metrics.FilesFailed.WithLabelValues(source).Inc()
+			event.Type, event.Error = events.DeliveryFailed, err.Error()
+		}
+		events.Emit(event)
+		if err := utils.RecordDelivery(store, serverName, name, timestamp, hash, destination, err); err != nil {
+			logger.Error("Error saving the state", "file", name, "error", err)
+		}
+	}
+	// transferred emits the event of a download of the file (failed if err is not nil), e.g. for the dashboard
+	transferred := func(name string, size int64, start time.Time, local string, err error) {
+		event := events.Event{Type: events.FileDownloaded, Server: source, Host: clientConf.Host, File: name, Local: local,
+			Size: size, Duration: events.Milliseconds(time.Since(start))}
+		if err != nil {
+			event.Type, event.Error = events.DownloadFailed, err.Error()
+		}
+		events.Emit(event)
+	}
+	for {
+		cycleStart := time.Now()
+		var files []*ftp.Entry
+		if client == nil {
+			// the last connection failed: it's retried at every poll
+			if !connect() {
+				return
+			}
+		} else if time.Since(lastCycle) >= idleCheckInterval {
+			// after a long wait the server may have closed the idle connection: it's checked and opened again
+			if err := client.NoOp(); err != nil {
+				logger.Warn("Connection lost: reconnecting", "error", err)
+				if !reconnect() {
+					return
+				}
+			}
+		}
+		if client == nil {
+			goto NEXT
+		}
+		// list the files in the ftp server and select only ones with the right extension
+		// (if the server works in push mode only, no file is downloaded)
+		metrics.Polls.WithLabelValues(source).Inc()
+		if utils.PullEnabled(clientConf) {
+			files, err = client.List(cwd)
+			if err != nil {
+				logger.Error("Error listing files", "error", err)
+				metrics.PollErrors.WithLabelValues(source).Inc()
+				health.fail(err)
+				report.fail(fmt.Errorf("listing files: %v", err))
+				// the session may have been dropped: the connection is opened again before the next poll
+				if report == nil {
+					logger.Warn("Reconnecting after the failed listing")
+					if !reconnect() {
+						return
+					}
+				}
+				goto NEXT // skip to the next iteration
+			}
+		}
+		metrics.LastPoll.WithLabelValues(source).SetToCurrentTime()
+		health.pollSucceeded()
+		for _, f := range files {
+			getFile = false
+			// If "f" is of type "file" then check if its extension matches the one in conf.json .
+			// ==> If, in conf.json, the "file_ext" is set to *, track all the files with all the extensions
+			if f.Type.String() == "file" && !utils.IsPostActionResult(clientConf, f.Name) && !utils.IsPushedFile(store, clientConf, f.Name) {
+				// get the file extension
+				if data := strings.Split(f.Name, "."); data[len(data)-1] == clientConf.FileExtension || clientConf.FileExtension == "*" {
+					report.found()
+					// CHECK if the file is present in the state
+					// (a file with a tombstone was deleted from the server in the past: it's handled as a new file)
+					info, ok, err := store.Get(source, f.Name)
+					if err != nil {
+						logger.Error("Error reading the state", "file", f.Name, "error", err)
+						report.delivered(err)
+						continue
+					}
+					timestamp := uint64(f.Time.Unix())
+					newVersion := false // the version wasn't seen before
+					if ok && info.Deleted == 0 {
+						// THE FILE WAS ALREADY SAVED => check if the retrieved timestamp is > the one saved
+						if timestamp > info.Timestamp {
+							logger.Info("Found update for file", "file", f.Name, "size", f.Size)
+							getFile, newVersion = true, true
+						} else if timestamp > info.Delivered && !inFlight.Has(f.Name, timestamp) {
+							// the version was seen but its delivery failed (or was never confirmed) => transfer it again
+							logger.Info("Retrying the delivery of file", "file", f.Name, "size", f.Size)
+							getFile = true
+						} else {
+							// the file has already the newest version (or its upload is in progress)
+							// logged at every poll for every file: only at debug level
+							logger.Debug("The file has already the newest version", "file", f.Name)
+							getFile = false
+						}
+					} else {
+						// th file, for the given host, was not previously saved => save the file in the state
+						logger.Info("Found new file", "file", f.Name, "size", f.Size)
+						getFile, newVersion = true, true
+					}
+					// record the version as seen (it's marked as delivered only when the delivery is confirmed)
+					if newVersion {
+						metrics.FilesDetected.WithLabelValues(source).Inc()
+						events.Emit(events.Event{Type: events.FileDetected, Server: source, Host: clientConf.Host, File: f.Name, Size: int64(f.Size)})
+						if err := utils.UpdateFileInfo(store, source, f, config.State.HistoryLimit); err != nil {
+							logger.Error("Error saving the state", "file", f.Name, "error", err)
+							report.delivered(err)
+							continue
+						}
+					}
+
+					// if the file needs to saved, upload it to the cloud. If there are problems, download it locally
+					if getFile {
+						logger.Debug("Downloading file", "file", f.Name, "size", f.Size)
+						start := time.Now()
+						reader, err := client.Retr(f.Name)
+						if err != nil {
+							logger.Error("Error pulling file", "file", f.Name, "error", err)
+							transferred(f.Name, 0, start, "", err)
+							recordDelivery(source, f.Name, uint64(f.Time.Unix()), "", "", err)
+							continue
+						}
+
+						// save files locally if there were errors uploading them to cloud
+						if !cloud.UploadEnabled() {
+							// save the file locally at: <data dir>/<source-ID>/ (compressed if the compression is enabled)
+							hash := sha256.New() // hash of the original file, saved in its history
+							localPath, err := utils.SaveFileLocally(io.TeeReader(reader, hash), filepath.Join(utils.LocalDir(source), utils.DeliveredFilename(f.Name, uint64(f.Time.Unix()))), compression, encryptor)
+							if err != nil {
+								logger.Error("Error saving local file", "file", f.Name, "error", err)
+								transferred(f.Name, 0, start, localPath, err)
+								recordDelivery(source, f.Name, uint64(f.Time.Unix()), "", localPath, err)
+								reader.Close()
+								continue
+							}
+							metrics.FilesDownloaded.WithLabelValues(source).Inc()
+							metrics.Transferred(source, metrics.Download, int64(f.Size), time.Since(start))
+							transferred(f.Name, int64(f.Size), start, localPath, nil)
+							recordDelivery(source, f.Name, uint64(f.Time.Unix()), hex.EncodeToString(hash.Sum(nil)), localPath, nil)
+
+							logger.Info("File successfully downloaded", "file", f.Name, "size", f.Size, "path", localPath, "duration", time.Since(start))
+							delivered.Add(f.Name, uint64(f.Time.Unix()))
+						} else { // send files to channel to upload them to cloud storage
+							// read bytes, build the FileToUpload obj and send it to the channel
+							data, err := io.ReadAll(reader)
+							if err != nil {
+								logger.Error("Error reading file", "file", f.Name, "error", err)
+								transferred(f.Name, 0, start, "", err)
+								recordDelivery(source, f.Name, uint64(f.Time.Unix()), "", "", err)
+								reader.Close()
+								continue
+							}
+							metrics.FilesDownloaded.WithLabelValues(source).Inc()
+							metrics.Transferred(source, metrics.Download, int64(len(data)), time.Since(start))
+							transferred(f.Name, int64(len(data)), start, "", nil)
+
+							file := utils.FileToUpload{
+								Data:         data,
+								Filename:     utils.DeliveredFilename(f.Name, uint64(f.Time.Unix())),
+								OriginalName: f.Name,
+								Host:         clientConf.Host,
+								ServerName:   clientConf.ServerName,
+								SourceID:     source,
+								Timestamp:    uint64(f.Time.Unix()),
+							}
+							sum := sha256.Sum256(data) // hash of the original file, saved in its history
+							file.Done = func(destination string, err error) {
+								recordDelivery(file.SourceID, file.OriginalName, file.Timestamp, hex.EncodeToString(sum[:]), destination, err)
+								inFlight.Done(file.OriginalName, file.Timestamp)
+								if err == nil {
+									delivered.Add(file.OriginalName, file.Timestamp)
+								}
+							}
+							if err := utils.CompressFile(&file, compression); err != nil {
+								logger.Error("Error compressing file", "file", f.Name, "error", err)
+								recordDelivery(source, f.Name, uint64(f.Time.Unix()), "", "", err)
+								reader.Close()
+								continue
+							}
+							if err := encryptor.EncryptFile(&file); err != nil {
+								logger.Error("Error encrypting file", "file", f.Name, "error", err)
+								recordDelivery(source, f.Name, uint64(f.Time.Unix()), "", "", err)
+								reader.Close()
+								continue
+							}
+							// the version is not transferred again while its upload is in progress
+							inFlight.Add(file.OriginalName, file.Timestamp)
+							fileChannel <- file
+							logger.Debug("File queued for upload", "file", f.Name, "size", f.Size, "duration", time.Since(start))
+						}
+						reader.Close()
+
+					}
+				}
+			}
+		}
+		// run the post-transfer action (if any) on the files whose delivery was confirmed
+		// (once mode: they're run after the uploads are confirmed, see below)
+		if report == nil {
+			if err := utils.MarkArchived(store, source, utils.RunPostActions(client, clientConf, files, delivered, logger)); err != nil {
+				logger.Error("Error saving the state", "error", err)
+			}
+		}
+		// mirror mode: propagate the deletion of the files no longer on the server
+		if utils.PullEnabled(clientConf) {
+			utils.MirrorDeletions(clientConf, files, store, cloud.Client(), compression, encryptor != nil, logger)
+		}
+		// upload to the server the new or changed files of the push source
+		if utils.PushEnabled(clientConf) {
+			utils.PushFiles(client, clientConf, cloud.Client(), store, logger)
+		}
+
+	NEXT:
+		// persist the state (only the JSON backend has pending changes to write)
+		if err := store.Flush(); err != nil {
+			logger.Error("Error saving the state", "error", err)
+		}
+		logger.Debug("Poll completed", "files", len(files), "duration", time.Since(cycleStart))
+		if report != nil {
+			// once mode: the files sent to the uploader are confirmed before the post-transfer actions and the exit,
+			// until the deadline of the pass (the uploads not confirmed are transferred again at the next pass)
+			if !inFlight.Wait(ctx) {
+				logger.Error("Timeout waiting for the uploads", "error", ctx.Err())
+				report.fail(fmt.Errorf("waiting for the uploads: %v", ctx.Err()))
+			}
+			if err := utils.MarkArchived(store, source, utils.RunPostActions(client, clientConf, files, delivered, logger)); err != nil {
+				logger.Error("Error saving the state", "error", err)
+			}
+			if err := store.Flush(); err != nil {
+				logger.Error("Error saving the state", "error", err)
+				report.fail(fmt.Errorf("saving the state: %v", err))
+			}
+			return
+		}
+		// wait for the next cycle, unless the goroutine must stop (the cycle in progress is always completed)
+		lastCycle = time.Now()
+		if !waitUntil(ctx, sched.Next(lastCycle), health, control, logger) {
+			return
+		}
+	}
+}
+
+/*
+waitUntil waits until the given time (forever if it's zero), or until a poll is requested with the control.
+If the server is paused, it then waits until it's resumed. It returns false if the goroutine must stop.
+The waits longer than a minute (e.g. until the next time of a cron expression) are logged.
+*/
+func waitUntil(ctx context.Context, t time.Time, health *serverHealth, control *serverControl, logger *slog.Logger) bool {
+	health.scheduled(t)
+	var timer <-chan time.Time // nil: never fires
+	if !t.IsZero() {
+		wait := time.Until(t)
+		if wait >= time.Minute {
+			logger.Info("Next poll", "at", t.Format(time.RFC3339))
+		}
+		timer = time.After(wait)
+	} else {
+		logger.Warn("No poll allowed by the schedule")
+	}
+	select {
+	case <-ctx.Done():
+		logger.Info("Stopped")
+		return false
+	case <-timer:
+	case <-control.polls():
+		logger.Info("Poll requested")
+	}
+	if resumed := control.waitResume(); resumed != nil {
+		logger.Info("Paused: waiting to be resumed")
+		select {
+		case <-ctx.Done():
+			logger.Info("Stopped")
+			return false
+		case <-resumed:
+			logger.Info("Resumed")
+		}
+	}
+	return true
+}
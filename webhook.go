@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"ftp-client/events"
+	"ftp-client/utils"
+	"ftp-client/webhooks"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// default address of the local receiver of the webhook listen command
+const defaultReceiverAddress = "127.0.0.1:8099"
+
+/*
+webhookCommand tries the webhooks of the configuration.
+Usage:
+  - webhook test [url]: sends a test event to the webhooks configured (or only to the one with the given URL)
+  - webhook listen [-secret s] [address]: runs a local receiver, which prints the events received and checks their signature
+
+It returns the exit code of the command.
+*/
+func webhookCommand(args []string) int {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: webhook test [url] | webhook listen [-secret s] [address]")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	switch args[0] {
+	case "test":
+		return webhookTest(args[1:])
+	case "listen":
+		return webhookListen(args[1:])
+	}
+	usage()
+	return 2
+}
+
+// webhookTest sends a test event to the webhooks of the configuration (a single attempt each)
+func webhookTest(args []string) int {
+	fs := flag.NewFlagSet("webhook test", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: webhook test [url] (default: all the webhooks)")
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	config, err := utils.LoadConfiguration(configFile)
+	if err != nil {
+		fmt.Printf("Invalid configuration:\n%s\n", err)
+		return 1
+	}
+	code, sent := 0, 0
+	for _, conf := range config.Webhooks {
+		if fs.NArg() == 1 && conf.URL != fs.Arg(0) {
+			continue
+		}
+		sent++
+		start := time.Now()
+		event := events.Event{Type: webhooks.Test, Time: start.UTC()}
+		if err := webhooks.Send(conf, "", event); err != nil {
+			fmt.Printf("%s: %v\n", conf.URL, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("%s: delivered in %s\n", conf.URL, time.Since(start).Round(time.Millisecond))
+	}
+	if sent == 0 {
+		fmt.Println("No webhook configured with the given URL")
+		return 1
+	}
+	return code
+}
+
+/*
+webhookListen runs a local HTTP receiver, to try the webhooks without a real endpoint (e.g. with the URL
+http://127.0.0.1:8099/ in the configuration). If the secret is set, the requests with an invalid signature are rejected.
+*/
+func webhookListen(args []string) int {
+	fs := flag.NewFlagSet("webhook listen", flag.ExitOnError)
+	secret := fs.String("secret", "", "secret of the signature (it can be a secret reference, e.g. env:NAME)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: webhook listen [-secret s] [address] (default: %s)\n", defaultReceiverAddress)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	address := defaultReceiverAddress
+	if fs.NArg() == 1 {
+		address = fs.Arg(0)
+	}
+	key, err := utils.ResolveSecret(*secret)
+	if err != nil {
+		fmt.Println("Error reading the secret: ", err)
+		return 1
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		signature := "not checked (no secret)"
+		valid := true
+		if key != "" {
+			valid = webhooks.Verify(key, r.Header.Get(webhooks.HeaderTimestamp), r.Header.Get(webhooks.HeaderSignature), payload)
+			signature = "valid"
+			if !valid {
+				signature = "INVALID"
+			}
+		}
+		var body bytes.Buffer
+		if json.Indent(&body, payload, "", "  ") != nil {
+			body.Reset()
+			body.Write(payload)
+		}
+		fmt.Printf("%s %s %s event=%s delivery=%s signature=%s\n%s\n\n", time.Now().Format(time.RFC3339), r.Method, r.URL.Path,
+			r.Header.Get(webhooks.HeaderEvent), r.Header.Get(webhooks.HeaderDelivery), signature, body.String())
+		if !valid {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	fmt.Printf("Listening on http://%s/\n", address)
+	srv := &http.Server{Addr: address, Handler: http.HandlerFunc(handler), ReadHeaderTimeout: 10 * time.Second}
+	if err := srv.ListenAndServe(); err != nil {
+		fmt.Println("Error starting the receiver: ", err)
+		return 1
+	}
+	return 0
+}
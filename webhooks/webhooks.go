@@ -0,0 +1,298 @@
+/*
+Package webhooks sends the events of the connector (see package events) to the HTTP endpoints configured, so that
+the downstream jobs are told when the files arrive (instead of polling the bucket) or when something fails.
+Every event is POSTed as a JSON object, signed with HMAC-SHA256 (see Sign), and its delivery is retried with an
+exponential backoff. Each webhook has its own queue and goroutine, so that a slow endpoint doesn't delay the others.
+*/
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ftp-client/events"
+	"ftp-client/model"
+	"ftp-client/utils"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// headers of the requests
+const (
+	HeaderEvent     = "X-FTPC-Event"     // type of the event
+	HeaderDelivery  = "X-FTPC-Delivery"  // unique ID of the event, the same in its retries
+	HeaderTimestamp = "X-FTPC-Timestamp" // unix time of the request, signed with the payload
+	HeaderSignature = "X-FTPC-Signature" // "sha256=" followed by the hex HMAC-SHA256 of "<timestamp>.<payload>"
+)
+
+// Test is the type of the event sent by Send to try a webhook (it's never emitted by the connector)
+const Test = "test"
+
+// events waiting to be delivered to a webhook: if the endpoint is down for long, the newer events are dropped
+const queueSize = 1000
+
+// max delay between two attempts to deliver an event
+const maxBackoff = 5 * time.Minute
+
+// Sign returns the signature of the payload sent at the given unix time, i.e. the value of the HeaderSignature header
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a request received (the values of the HeaderTimestamp and HeaderSignature headers)
+func Verify(secret, timestamp, signature string, payload []byte) bool {
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(Sign(secret, t, payload)))
+}
+
+// statusError is the status code of a request that failed
+type statusError struct {
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.code, http.StatusText(e.code))
+}
+
+// retryable reports whether the delivery of the event can succeed later (the other client errors are permanent)
+func (e statusError) retryable() bool {
+	return e.code >= 500 || e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests
+}
+
+/*
+Send makes a single attempt to deliver the event to the webhook, with the given delivery ID (a new one if empty).
+The secret of the webhook is read at every attempt, since it can be a reference (see utils.ResolveSecret).
+*/
+func Send(conf model.Webhook, id string, e events.Event) error {
+	secret, err := utils.ResolveSecret(string(conf.Secret))
+	if err != nil {
+		return fmt.Errorf("reading the secret: %v", err)
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding the event: %v", err)
+	}
+	if id == "" {
+		id = newID()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.Timeout)*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ftp-client")
+	req.Header.Set(HeaderEvent, e.Type)
+	req.Header.Set(HeaderDelivery, id)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(now, 10))
+	if secret != "" {
+		req.Header.Set(HeaderSignature, Sign(secret, now, payload))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) // the connection is reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return statusError{resp.StatusCode}
+	}
+	return nil
+}
+
+// delivery is an event queued for a webhook
+type delivery struct {
+	id    string
+	event events.Event
+}
+
+// hook is a webhook in use, with the queue of its events
+type hook struct {
+	conf   model.Webhook
+	events map[string]bool // types of the events sent (nil: all of them)
+	queue  chan delivery
+}
+
+/*
+Dispatcher delivers the events to the webhooks configured. Its Notify method is subscribed to the events
+(see events.Subscribe): it only queues the event, so the connector is never slowed down by the endpoints.
+*/
+type Dispatcher struct {
+	mu    sync.RWMutex
+	confs []model.Webhook
+	hooks []*hook
+	wg    sync.WaitGroup // goroutines of the webhooks, including the ones replaced
+
+	closing   chan struct{} // closed when Close times out: the retries are given up
+	closeOnce sync.Once
+}
+
+// New returns a dispatcher of the given webhooks
+func New(confs []model.Webhook) *Dispatcher {
+	d := &Dispatcher{closing: make(chan struct{})}
+	d.Apply(confs)
+	return d
+}
+
+/*
+Apply replaces the webhooks, if they changed (e.g. the configuration was reloaded). The events already queued
+for the old webhooks are still delivered to them.
+*/
+func (d *Dispatcher) Apply(confs []model.Webhook) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if reflect.DeepEqual(confs, d.confs) {
+		return
+	}
+	d.stop()
+	d.confs = confs
+	for _, conf := range confs {
+		h := &hook{conf: conf, queue: make(chan delivery, queueSize)}
+		if len(conf.Events) > 0 {
+			h.events = make(map[string]bool, len(conf.Events))
+			for _, t := range conf.Events {
+				h.events[t] = true
+			}
+		}
+		d.hooks = append(d.hooks, h)
+		d.wg.Add(1)
+		go d.work(h)
+	}
+	if len(confs) > 0 {
+		slog.Info("Webhooks applied", "webhooks", len(confs))
+	}
+}
+
+// stop closes the queues of the webhooks in use (their goroutines return once the events queued are delivered)
+func (d *Dispatcher) stop() {
+	for _, h := range d.hooks {
+		close(h.queue)
+	}
+	d.confs, d.hooks = nil, nil
+}
+
+// Notify queues the event for the webhooks whose filter matches it
+func (d *Dispatcher) Notify(e events.Event) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, h := range d.hooks {
+		if h.events != nil && !h.events[e.Type] {
+			continue
+		}
+		select {
+		case h.queue <- delivery{id: newID(), event: e}:
+		default:
+			slog.Error("Webhook queue full: event dropped", "url", redactURL(h.conf.URL), "event", e.Type, "server", e.Server, "file", e.File)
+		}
+	}
+}
+
+/*
+Close stops the dispatcher, waiting at most the timeout for the events queued to be delivered (e.g. before the
+process exits). It reports whether they were all delivered (or given up). On timeout, the deliveries waiting
+to be retried and the events still queued are dropped.
+*/
+func (d *Dispatcher) Close(timeout time.Duration) bool {
+	d.mu.Lock()
+	d.stop()
+	d.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		d.closeOnce.Do(func() { close(d.closing) })
+		return false
+	}
+}
+
+// work delivers the events queued for the webhook, until its queue is closed
+func (d *Dispatcher) work(h *hook) {
+	defer d.wg.Done()
+	for dl := range h.queue {
+		select {
+		case <-d.closing:
+			slog.Error("Webhook not delivered: event dropped", "url", redactURL(h.conf.URL), "event", dl.event.Type,
+				"delivery", dl.id, "error", "dispatcher closed")
+			continue
+		default:
+		}
+		h.deliver(dl, d.closing)
+	}
+}
+
+/*
+deliver sends the event to the webhook, retrying with an exponential backoff until the max attempts are reached.
+The retries are given up when the closing channel is closed.
+*/
+func (h *hook) deliver(dl delivery, closing <-chan struct{}) {
+	log := slog.With("url", redactURL(h.conf.URL), "event", dl.event.Type, "delivery", dl.id)
+	delay := time.Duration(h.conf.Retry) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := Send(h.conf, dl.id, dl.event)
+		if err == nil {
+			log.Debug("Webhook delivered", "attempt", attempt, "duration", time.Since(start))
+			return
+		}
+		var sErr statusError
+		if attempt >= h.conf.MaxAttempts || (errors.As(err, &sErr) && !sErr.retryable()) {
+			log.Error("Webhook not delivered: event dropped", "attempt", attempt, "error", err)
+			return
+		}
+		log.Warn("Error delivering webhook: retrying", "attempt", attempt, "retry_in", delay, "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-closing:
+			timer.Stop()
+			log.Error("Webhook not delivered: event dropped", "attempt", attempt, "error", "dispatcher closed")
+			return
+		}
+		delay *= 2
+		if delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+}
+
+// newID returns a random ID of a delivery
+func newID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// redactURL returns the URL to log: the credentials and the query (which may contain a token) are removed
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	u.User, u.RawQuery, u.Fragment = nil, "", ""
+	return u.String()
+}
@@ -0,0 +1,252 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"ftp-client/events"
+	"ftp-client/model"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// request is a request received by the test endpoint
+type request struct {
+	at       time.Time
+	event    events.Event
+	delivery string
+}
+
+// endpoint is a webhook endpoint that answers with the given status codes, in order (the last one is repeated)
+type endpoint struct {
+	mu       sync.Mutex
+	codes    []int
+	delay    time.Duration // before answering
+	requests []request
+	server   *httptest.Server
+}
+
+func newEndpoint(t *testing.T, delay time.Duration, codes ...int) *endpoint {
+	t.Helper()
+	ep := &endpoint{codes: codes, delay: delay}
+	ep.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e events.Event
+		json.NewDecoder(r.Body).Decode(&e)
+		time.Sleep(ep.delay)
+		ep.mu.Lock()
+		ep.requests = append(ep.requests, request{at: time.Now(), event: e, delivery: r.Header.Get(HeaderDelivery)})
+		code := ep.codes[len(ep.codes)-1]
+		if len(ep.requests) <= len(ep.codes) {
+			code = ep.codes[len(ep.requests)-1]
+		}
+		ep.mu.Unlock()
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(ep.server.Close)
+	return ep
+}
+
+func (ep *endpoint) received() []request {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return append([]request(nil), ep.requests...)
+}
+
+// webhook returns the configuration of a webhook that sends the events to the endpoint
+func (ep *endpoint) webhook() model.Webhook {
+	return model.Webhook{URL: ep.server.URL, Timeout: 2000, MaxAttempts: 3, Retry: 20}
+}
+
+func TestSignVerify(t *testing.T) {
+	const secret = "s3cret"
+	payload := []byte(`{"type":"file_delivered"}`)
+	signature := Sign(secret, 1700000000, payload)
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		signature string
+		payload   []byte
+		want      bool
+	}{
+		{"valid", secret, "1700000000", signature, payload, true},
+		{"wrong secret", "other", "1700000000", signature, payload, false},
+		{"other timestamp", secret, "1700000001", signature, payload, false},
+		{"invalid timestamp", secret, "now", signature, payload, false},
+		{"payload changed", secret, "1700000000", signature, []byte(`{"type":"file_uploaded"}`), false},
+		{"no signature", secret, "1700000000", "", payload, false},
+	}
+	for _, tt := range tests {
+		if got := Verify(tt.secret, tt.timestamp, tt.signature, tt.payload); got != tt.want {
+			t.Errorf("%s: Verify = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSendSigned(t *testing.T) {
+	const secret = "s3cret"
+	verified := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		verified <- r.Header.Get(HeaderEvent) == events.FileDelivered &&
+			Verify(secret, r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderSignature), payload)
+	}))
+	defer server.Close()
+	conf := model.Webhook{URL: server.URL, Secret: secret, Timeout: 2000}
+	if err := Send(conf, "", events.Event{Type: events.FileDelivered, Server: "line3", File: "a.csv"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if !<-verified {
+		t.Error("the signature of the request received is not valid")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		codes    []int
+		attempts int
+	}{
+		{"delivered", []int{http.StatusNoContent}, 1},
+		{"server error, then delivered", []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK}, 3},
+		{"server error", []int{http.StatusBadGateway}, 3},
+		{"too many requests", []int{http.StatusTooManyRequests}, 3},
+		{"bad request", []int{http.StatusBadRequest}, 1},
+		{"not found", []int{http.StatusNotFound, http.StatusOK}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ep := newEndpoint(t, 0, tt.codes...)
+			d := New([]model.Webhook{ep.webhook()})
+			d.Notify(events.Event{Type: events.FileDelivered, Server: "line3", File: "a.csv"})
+			if !d.Close(5 * time.Second) {
+				t.Fatal("Close timed out")
+			}
+			got := ep.received()
+			if len(got) != tt.attempts {
+				t.Fatalf("attempts = %d, want %d", len(got), tt.attempts)
+			}
+			retry := time.Duration(ep.webhook().Retry) * time.Millisecond
+			for i := 1; i < len(got); i++ {
+				if got[i].delivery != got[0].delivery {
+					t.Errorf("attempt %d: delivery %q, want %q (the same of the first attempt)", i+1, got[i].delivery, got[0].delivery)
+				}
+				// the delay is doubled at every attempt
+				if want := retry << (i - 1); got[i].at.Sub(got[i-1].at) < want {
+					t.Errorf("attempt %d after %s, want at least %s", i+1, got[i].at.Sub(got[i-1].at), want)
+				}
+			}
+		})
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	all := newEndpoint(t, 0, http.StatusOK)
+	filtered := newEndpoint(t, 0, http.StatusOK)
+	conf := filtered.webhook()
+	conf.Events = []string{events.ServerUnreachable, events.ServerRecovered}
+	d := New([]model.Webhook{all.webhook(), conf})
+	sent := []string{events.FileDelivered, events.ServerUnreachable, events.DeliveryFailed, events.ServerRecovered}
+	for _, typ := range sent {
+		d.Notify(events.Event{Type: typ, Server: "line3"})
+	}
+	if !d.Close(5 * time.Second) {
+		t.Fatal("Close timed out")
+	}
+	if got := types(all.received()); !equal(got, sent) {
+		t.Errorf("webhook without filter received %v, want %v", got, sent)
+	}
+	if got := types(filtered.received()); !equal(got, conf.Events) {
+		t.Errorf("webhook with filter received %v, want %v", got, conf.Events)
+	}
+}
+
+func TestCloseDrainsQueue(t *testing.T) {
+	ep := newEndpoint(t, 10*time.Millisecond, http.StatusOK)
+	d := New([]model.Webhook{ep.webhook()})
+	for i := 0; i < 10; i++ {
+		d.Notify(events.Event{Type: events.FileDelivered, File: strconv.Itoa(i)})
+	}
+	if !d.Close(5 * time.Second) {
+		t.Fatal("Close timed out")
+	}
+	got := ep.received()
+	if len(got) != 10 {
+		t.Fatalf("received %d events, want 10", len(got))
+	}
+	// each webhook delivers its events in order
+	for i, r := range got {
+		if r.event.File != strconv.Itoa(i) {
+			t.Errorf("event %d: file %q, want %q", i, r.event.File, strconv.Itoa(i))
+		}
+	}
+	// the events notified after Close are dropped
+	d.Notify(events.Event{Type: events.FileDelivered})
+	if len(ep.received()) != 10 {
+		t.Error("an event notified after Close was delivered")
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	ep := newEndpoint(t, 300*time.Millisecond, http.StatusOK)
+	d := New([]model.Webhook{ep.webhook()})
+	d.Notify(events.Event{Type: events.FileDelivered})
+	start := time.Now()
+	if d.Close(50 * time.Millisecond) {
+		t.Error("Close = true, want false (the event is still being delivered)")
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("Close returned after %s, want about the timeout", elapsed)
+	}
+}
+
+func types(requests []request) []string {
+	var t []string
+	for _, r := range requests {
+		t = append(t, r.event.Type)
+	}
+	return t
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCloseGivesUpRetries(t *testing.T) {
+	ep := newEndpoint(t, 0, http.StatusServiceUnavailable)
+	conf := ep.webhook()
+	conf.MaxAttempts, conf.Retry = 5, 10000
+	d := New([]model.Webhook{conf})
+	for i := 0; i < 3; i++ {
+		d.Notify(events.Event{Type: events.FileDelivered, File: strconv.Itoa(i)})
+	}
+	time.Sleep(50 * time.Millisecond) // the first attempt fails, the retry is in 10s
+	if d.Close(50 * time.Millisecond) {
+		t.Fatal("Close = true, want false (the event is waiting to be retried)")
+	}
+	// the goroutine of the webhook returns without waiting for the retry, dropping the events queued
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the webhook is still waiting to retry after Close")
+	}
+	if got := len(ep.received()); got != 1 {
+		t.Errorf("received %d requests, want 1", got)
+	}
+}